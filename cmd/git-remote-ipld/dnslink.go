@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+// DNSLINK_PREFIX follows IPLD_PREFIX in remotes like
+// ipld://dnslink/git.example.org, the root is read from the domain's
+// _dnslink TXT record
+const DNSLINK_PREFIX = "dnslink/"
+
+// txtResolver looks up DNS TXT records, net.Resolver satisfies it
+type txtResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// dnsResolver is used by handlers created in Main, tests replace it
+var dnsResolver txtResolver = net.DefaultResolver
+
+// resolveDNSLink points the handler at the root published by h.dnslink, a
+// path in the record goes in front of the subpath of the url. Records on
+// _dnslink.<domain> take precedence over ones on the domain itself. Each
+// lookup is bound by timeout unless it is 0.
+func (h *IpnsHandler) resolveDNSLink(ctx context.Context, timeout time.Duration) error {
+	if timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var lookupErr error
+	for _, name := range []string{"_dnslink." + h.dnslink, h.dnslink} {
+		records, err := h.resolver.LookupTXT(ctx, name)
+		if err != nil {
+			if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+				continue
+			}
+			lookupErr = err
+			continue
+		}
+
+		root, subpath, err := parseDNSLink(records)
+		if err != nil {
+			return fmt.Errorf("dnslink %s: %v", name, err)
+		}
+		if root != "" {
+			h.remoteName = root
+			h.currentHash = root
+			h.dnslinkPath = subpath
+			if subpath != "" {
+				h.subpath = path.Join(subpath, h.subpath)
+			}
+			return nil
+		}
+	}
+
+	if lookupErr != nil {
+		return fmt.Errorf("dnslink %s: %v", h.dnslink, lookupErr)
+	}
+	return fmt.Errorf("dnslink %s: no dnslink record found", h.dnslink)
+}
+
+// parseDNSLink returns the root cid and path of the first dnslink=/ipfs/
+// record, or an empty root if there is no dnslink record
+func parseDNSLink(records []string) (string, string, error) {
+	for _, r := range records {
+		if !strings.HasPrefix(r, "dnslink=") {
+			continue
+		}
+
+		p := strings.TrimPrefix(r, "dnslink=")
+		if !strings.HasPrefix(p, "/ipfs/") {
+			return "", "", fmt.Errorf("unsupported record %q, expected an /ipfs/ path", r)
+		}
+
+		parts := strings.SplitN(strings.Trim(strings.TrimPrefix(p, "/ipfs/"), "/"), "/", 2)
+		if _, err := cid.Parse(parts[0]); err != nil {
+			return "", "", fmt.Errorf("record %q: %v", r, err)
+		}
+		if len(parts) == 1 {
+			return parts[0], "", nil
+		}
+
+		sub := path.Clean("/" + parts[1])
+		if sub != "/"+parts[1] {
+			return "", "", fmt.Errorf("record %q: unclean path %s", r, parts[1])
+		}
+		return parts[0], sub[1:], nil
+	}
+	return "", "", nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+
+	"github.com/ipfs-shipyard/git-remote-ipld/core"
+)
+
+// isFsck tells `git-remote-ipld fsck -- [flags]` apart from git running the
+// helper for a remote which happens to be named fsck. Git passes either no
+// url or one that can't start with a dash, so a flag or `--` is required.
+func isFsck(args []string) bool {
+	return len(args) >= 3 && args[1] == "fsck" && strings.HasPrefix(args[2], "-")
+}
+
+// findGitDir returns GIT_DIR, or the repository of the current directory
+func findGitDir() (string, error) {
+	gitDir := os.Getenv("GIT_DIR")
+	if gitDir == "" {
+		out, err := exec.Command("git", "rev-parse", "--git-dir").Output()
+		if err != nil {
+			return "", fmt.Errorf("not in a git repository: %v", err)
+		}
+		gitDir = strings.TrimSpace(string(out))
+	}
+	return filepath.Abs(gitDir)
+}
+
+// fsck checks tracker entries of the repository in GIT_DIR, or the current
+// directory, against the block store and local objects. The tracker doesn't
+// know which store an object came from, --remote picks the store of a remote
+// instead of the default one.
+func fsck(args []string, logger *log.Logger) error {
+	if logger == nil {
+		logger = log.New(os.Stderr, "", 0)
+	}
+
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	flags.SetOutput(logger.Writer())
+	repair := flags.Bool("repair", false, "remove stale entries, so the next push or fetch transfers the objects again")
+	remote := flags.String("remote", "", "check against the store of this remote, given by name or url")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	gitDir, err := findGitDir()
+	if err != nil {
+		return fmt.Errorf("fsck: %v", err)
+	}
+
+	repo, err := core.OpenRepo(gitDir)
+	if err != nil {
+		return fmt.Errorf("fsck: %v", err)
+	}
+
+	store, err := fsckStore(*remote)
+	if err != nil {
+		return fmt.Errorf("fsck: %v", err)
+	}
+	if closer, ok := store.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	tracker, err := core.NewTracker(gitDir)
+	if err != nil {
+		return fmt.Errorf("fsck: %v", err)
+	}
+	defer tracker.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	jobs, err := core.ConfigJobs(gitDir, "fetchJobs", core.FETCH_JOBS_ENV)
+	if err != nil {
+		return fmt.Errorf("fsck: %v", err)
+	}
+
+	check := core.NewFsck(tracker, repo, store, core.NewLimiter(jobs))
+	check.Repair = *repair
+	report, err := check.Run(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range report.Stale {
+		logger.Printf("stale %s: missing from %s\n", e.Hash, e.Missing())
+	}
+	logger.Printf("checked %d entries, %d stale\n", report.Checked, len(report.Stale))
+
+	if *repair {
+		if report.Removed > 0 {
+			logger.Printf("removed %d entries\n", report.Removed)
+		}
+		return nil
+	}
+	if len(report.Stale) > 0 {
+		return fmt.Errorf("fsck: %d stale entries, run with --repair to remove them", len(report.Stale))
+	}
+	return nil
+}
+
+// fsckStore opens the store of a remote, or the default one when no remote is
+// given
+func fsckStore(remote string) (core.BlockStore, error) {
+	if remote == "" {
+		_, store, err := openStore()
+		return store, err
+	}
+
+	raw := remote
+	if !strings.Contains(remote, "://") {
+		var err error
+		if raw, err = remoteConfigURL(remote); err != nil {
+			return nil, err
+		}
+	}
+
+	u, err := parseURL(raw)
+	if err != nil {
+		return nil, err
+	}
+	_, store, err := newHandler(u, remote)
+	return store, err
+}
@@ -2,11 +2,14 @@ package main
 
 import (
 	"bytes"
-	"errors"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"path"
 	"strings"
+	"sync"
+	"time"
 
 	core "github.com/ipfs-shipyard/git-remote-ipld/core"
 	ipfs "github.com/ipfs/go-ipfs-api"
@@ -32,38 +35,280 @@ type refPath struct {
 	hash string
 }
 
+// ipfsAPI is the subset of the go-ipfs http api the handler needs to
+// maintain the repository root directory
+type ipfsAPI interface {
+	Cat(ctx context.Context, path string) (io.ReadCloser, error)
+	List(ctx context.Context, path string) ([]*ipfs.LsLink, error)
+	Add(ctx context.Context, r io.Reader) (string, error)
+	PatchLink(ctx context.Context, root, path, childhash string, create bool) (string, error)
+	Patch(ctx context.Context, root, action string, args ...string) (string, error)
+	ResolvePath(ctx context.Context, path string) (string, error)
+	DagPut(ctx context.Context, data []byte, ienc, kind string) (string, error)
+	Pin(ctx context.Context, path string) error
+	Unpin(ctx context.Context, path string) error
+
+	// Key looks up a keystore key by name or id, both are empty if there
+	// is no such key
+	Key(ctx context.Context, nameOrID string) (name string, id string, err error)
+	// Resolve looks up an ipns name, nocache skips the daemon's cache
+	Resolve(ctx context.Context, name string, nocache bool) (string, error)
+	PublishWithDetails(ctx context.Context, contentHash, key string, lifetime, ttl time.Duration, resolve bool) (*ipfs.PublishResponse, error)
+}
+
 type IpnsHandler struct {
-	api *ipfs.Shell
+	api ipfsAPI
 
 	remoteName  string
 	currentHash string
 
+	// patchLk serializes patches of currentHash made while push stores
+	// large objects in parallel
+	patchLk sync.Mutex
+
+	// subpath is where the repository lives below outerRoot, the directory
+	// the remote url points to. Without it both roots are the same.
+	subpath   string
+	outerRoot string
+
+	// gitRemote is the name git knows the remote by, or its url
+	gitRemote string
+
+	// ipnsName is set for ipns:// remotes, which are published with ipnsKey
+	ipnsName string
+	ipnsKey  string
+	ipnsID   string
+
+	// dnslink is the domain of ipld://dnslink/ remotes, looked up with
+	// resolver. The record may point at dnslinkPath below the root.
+	dnslink     string
+	dnslinkPath string
+	resolver    txtResolver
+
+	// updates are ref changes made by this push, replayed if the ipns name
+	// moved in the meantime
+	updates []refUpdate
+
+	// pushedRefs are recorded in the tracker once published, deleted refs
+	// are nil
+	pushedRefs map[string]*plumbing.Hash
+
 	largeObjs map[string]string
 
-	didPush bool
+	// carPath is where pushed repository is exported as a CAR archive, if set
+	carPath string
+	car     *core.CarWriter
+
+	// dryRun redirects root directory changes into memory, see startDryRun
+	dryRun        bool
+	overlay       *overlayStore
+	pushedObjects uint64
+	pushedBytes   uint64
+
+	// recoveredObjects were stored by interrupted earlier pushes
+	recoveredObjects uint64
+
+	// root is the outer root published by this push
+	root string
 }
 
-func (h *IpnsHandler) Initialize(remote *core.Remote) error {
-	h.api = ipfs.NewLocalShell()
+func (h *IpnsHandler) Initialize(ctx context.Context, remote *core.Remote) error {
 	h.currentHash = h.remoteName
+	h.pushedRefs = map[string]*plumbing.Hash{}
+
+	// requests to the daemon are bound by the block timeout
+	if s, ok := h.api.(*shellAPI); ok {
+		s.timeout = remote.BlockTimeout()
+	}
+
+	if h.ipnsName != "" {
+		if err := h.resolveName(ctx, remote); err != nil {
+			return err
+		}
+	}
+
+	if h.dnslink != "" {
+		if err := h.resolveDNSLink(ctx, remote.BlockTimeout()); err != nil {
+			return err
+		}
+	}
+
+	h.outerRoot = h.remoteName
+	root, err := h.repoRoot(ctx, h.outerRoot)
+	if err != nil {
+		return err
+	}
+	h.remoteName = root
+	h.currentHash = root
+
+	if h.carPath != "" {
+		car, err := core.NewCarWriter()
+		if err != nil {
+			return err
+		}
+		h.car = car
+	}
 	return nil
 }
 
-func (h *IpnsHandler) Finish(remote *core.Remote) error {
-	//TODO: publish
-	if h.didPush {
-		if err := h.fillMissingLobjs(remote.Tracker); err != nil {
-			return err
+// Publish links the pushed repository into the outer root and points the
+// ipns name at it. A name which moved since the push started is rebased onto
+// first, refs updated on both sides fail with core.ErrFetchFirst.
+func (h *IpnsHandler) Publish(ctx context.Context, remote *core.Remote, refs []string) (map[string]error, error) {
+	if err := h.fillMissingLobjs(ctx, remote.Tracker); err != nil {
+		return nil, err
+	}
+
+	var failed map[string]error
+	if h.ipnsName != "" && !h.dryRun {
+		var err error
+		if failed, err = h.rebase(ctx, remote); err != nil {
+			return nil, err
+		}
+		if len(failed) == len(refs) {
+			// nothing of ours is left to publish
+			return failed, nil
+		}
+	}
+
+	root, err := h.patchOuter(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.dryRun {
+		remote.Logger.Printf("Dry run: would push %d objects (%d bytes) as \x1b[32mipld://%s\x1b[39m\n", h.pushedObjects, h.pushedBytes, h.rootURL(root))
+		if h.ipnsName != "" {
+			remote.Logger.Printf("Dry run: would publish it as \x1b[32mipns://%s\x1b[39m\n", h.ipnsName)
+		}
+		return nil, nil
+	}
+
+	if h.recoveredObjects > 0 {
+		remote.Logger.Printf("Resumed interrupted push, %d objects were already stored\n", h.recoveredObjects)
+	}
+	remote.Logger.Printf("Pushed to IPFS as \x1b[32mipld://%s\x1b[39m\n", h.rootURL(root))
+	if h.dnslink != "" {
+		remote.Logger.Printf("Point the dnslink record of %s to /ipfs/%s to publish it\n", h.dnslink, path.Join(root, h.dnslinkPath))
+	}
+
+	// rebase resolved the name just now, anything slow waits until after
+	// publishing so others have little chance to publish in between
+	if h.ipnsName != "" {
+		if err := h.publish(ctx, remote, root); err != nil {
+			return nil, err
 		}
+	}
 
-		remote.Logger.Printf("Pushed to IPFS as \x1b[32mipld://%s\x1b[39m\n", h.currentHash)
+	for ref, hash := range h.pushedRefs {
+		if failed[ref] != nil {
+			continue
+		}
+		if hash == nil {
+			err = remote.Tracker.Delete(ref)
+		} else {
+			err = remote.Tracker.Set(ref, hash[:])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	h.root = root
+	return failed, nil
+}
+
+// Finish pins and exports the published root. Git was told about the refs
+// already, a failed pin doesn't fail the push.
+func (h *IpnsHandler) Finish(ctx context.Context, remote *core.Remote) error {
+	if h.root == "" {
+		return nil
+	}
+
+	if err := h.pinRoot(ctx, remote, h.root); err != nil {
+		remote.Logger.Printf("warning: %v\n", err)
+	}
+	if err := h.pinRemote(ctx, remote, h.root); err != nil {
+		remote.Logger.Printf("warning: %v\n", err)
+	}
+
+	if h.car != nil {
+		return h.exportCar(ctx, remote, h.currentHash)
 	}
 	return nil
 }
 
-func (h *IpnsHandler) ProvideBlock(cid string, tracker *core.Tracker) ([]byte, error) {
+// Close discards the archive being exported, if any
+func (h *IpnsHandler) Close() error {
+	if h.car == nil {
+		return nil
+	}
+	err := h.car.Close()
+	h.car = nil
+	return err
+}
+
+// repoRoot returns the repository directory below outer, or an empty one if
+// there is nothing at subpath yet
+func (h *IpnsHandler) repoRoot(ctx context.Context, outer string) (string, error) {
+	if h.subpath == "" {
+		return outer, nil
+	}
+
+	root, err := h.refCid(ctx, outer, h.subpath)
+	if err != nil {
+		return "", fmt.Errorf("resolve %s/%s: %v", outer, h.subpath, err)
+	}
+	if root == "" {
+		return EMPTY_REPO, nil
+	}
+	return root, nil
+}
+
+// patchOuter links the updated repository back into the outer root, any
+// directories on the way are patched too
+func (h *IpnsHandler) patchOuter(ctx context.Context) (string, error) {
+	if h.subpath == "" {
+		return h.currentHash, nil
+	}
+
+	root, err := h.api.PatchLink(ctx, h.outerRoot, h.subpath, h.currentHash, true)
+	if err != nil {
+		return "", fmt.Errorf("patch %s/%s: %v", h.outerRoot, h.subpath, err)
+	}
+	return root, nil
+}
+
+func (h *IpnsHandler) rootURL(root string) string {
+	if h.subpath == "" {
+		return root
+	}
+	return root + "/" + h.subpath
+}
+
+// exportCar writes everything reachable from the repository root into
+// h.carPath. Directories around a repository in a subpath are left out, the
+// archive is rooted at the repository like ipld+car:// remotes expect.
+func (h *IpnsHandler) exportCar(ctx context.Context, remote *core.Remote, repo string) error {
+	root, err := cid.Parse(repo)
+	if err != nil {
+		return err
+	}
+
+	err = h.car.Finish(root, func(c cid.Cid) ([]byte, error) {
+		return remote.Store.Get(ctx, c.String())
+	}, h.carPath)
+	if err != nil {
+		return err
+	}
+
+	remote.Logger.Printf("Exported %d blocks to %s\n", h.car.Len(), h.carPath)
+	return nil
+}
+
+func (h *IpnsHandler) ProvideBlock(ctx context.Context, cid string, tracker *core.Tracker) ([]byte, error) {
 	if h.largeObjs == nil {
-		if err := h.loadObjectMap(); err != nil {
+		if err := h.loadObjectMap(ctx); err != nil {
 			return nil, err
 		}
 	}
@@ -77,17 +322,18 @@ func (h *IpnsHandler) ProvideBlock(cid string, tracker *core.Tracker) ([]byte, e
 		return nil, err
 	}
 
-	r, err := h.api.Cat(fmt.Sprintf("/ipfs/%s", mappedCid))
+	r, err := h.api.Cat(ctx, fmt.Sprintf("/ipfs/%s", mappedCid))
 	if err != nil {
-		return nil, errors.New("cat error")
+		return nil, fmt.Errorf("cat error: %v", err)
 	}
+	defer r.Close()
 
 	data, err := ioutil.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
 
-	realCid, err := h.api.DagPut(data, "raw", "git")
+	realCid, err := h.api.DagPut(ctx, data, "raw", "git")
 	if err != nil {
 		return nil, err
 	}
@@ -99,10 +345,10 @@ func (h *IpnsHandler) ProvideBlock(cid string, tracker *core.Tracker) ([]byte, e
 	return data, nil
 }
 
-func (h *IpnsHandler) loadObjectMap() error {
+func (h *IpnsHandler) loadObjectMap(ctx context.Context) error {
 	h.largeObjs = map[string]string{}
 
-	links, err := h.api.List(h.currentHash + "/" + LARGE_OBJECT_DIR)
+	links, err := h.api.List(ctx, h.currentHash+"/"+LARGE_OBJECT_DIR)
 	if err != nil {
 		//TODO: Find a better way with coreapi
 		if isNoLink(err) {
@@ -118,10 +364,10 @@ func (h *IpnsHandler) loadObjectMap() error {
 	return nil
 }
 
-func (h *IpnsHandler) List(remote *core.Remote, forPush bool) ([]string, error) {
+func (h *IpnsHandler) List(ctx context.Context, remote *core.Remote, forPush bool) ([]string, error) {
 	out := make([]string, 0)
 	if !forPush {
-		refs, err := h.paths(h.api, h.remoteName, 0)
+		refs, err := h.paths(ctx, h.api, h.remoteName, 0)
 		if err != nil {
 			return nil, err
 		}
@@ -143,7 +389,7 @@ func (h *IpnsHandler) List(remote *core.Remote, forPush bool) ([]string, error)
 				out = append(out, fmt.Sprintf("%s %s", hash, r))
 			case REFPATH_REF:
 				r := path.Join(strings.Split(ref.path, "/")[1:]...)
-				dest, err := h.getRef(r)
+				dest, err := h.getRef(ctx, r)
 				if err != nil {
 					return nil, err
 				}
@@ -160,20 +406,12 @@ func (h *IpnsHandler) List(remote *core.Remote, forPush bool) ([]string, error)
 		err = it.ForEach(func(ref *plumbing.Reference) error {
 			remoteRef := "0000000000000000000000000000000000000000"
 
-			localRef, err := h.api.ResolvePath(path.Join(h.currentHash, ref.Name().String()))
-			if err != nil && !isNoLink(err) {
+			hash, err := h.remoteRefHash(ctx, ref.Name().String())
+			if err != nil {
 				return err
 			}
-			if err == nil {
-				refCid, err := cid.Parse(localRef)
-				if err != nil {
-					return err
-				}
-
-				remoteRef, err = core.HexFromCid(refCid)
-				if err != nil {
-					return err
-				}
+			if hash != nil {
+				remoteRef = hash.String()
 			}
 
 			out = append(out, fmt.Sprintf("%s %s", remoteRef, ref.Name()))
@@ -188,8 +426,14 @@ func (h *IpnsHandler) List(remote *core.Remote, forPush bool) ([]string, error)
 	return out, nil
 }
 
-func (h *IpnsHandler) Push(remote *core.Remote, local string, remoteRef string) (string, error) {
-	h.didPush = true
+func (h *IpnsHandler) Push(ctx context.Context, remote *core.Remote, local string, remoteRef string, force bool) (string, error) {
+	if err := h.checkPublish(); err != nil {
+		return "", err
+	}
+
+	if local == "" {
+		return h.delete(ctx, remote, remoteRef)
+	}
 
 	localRef, err := remote.Repo.Reference(plumbing.ReferenceName(local), true)
 	if err != nil {
@@ -198,74 +442,215 @@ func (h *IpnsHandler) Push(remote *core.Remote, local string, remoteRef string)
 
 	headHash := localRef.Hash().String()
 
-	push := remote.NewPush()
-	push.NewNode = h.bigNodePatcher(remote.Tracker)
-
-	err = push.PushHash(headHash)
+	headCid, err := core.CidFromHex(headHash)
 	if err != nil {
-		return "", fmt.Errorf("command push: %v", err)
+		return "", fmt.Errorf("push: %v", err)
 	}
 
-	hash := localRef.Hash()
-	remote.Tracker.Set(remoteRef, (&hash)[:])
+	if !force {
+		oldHash, err := h.remoteRefHash(ctx, remoteRef)
+		if err != nil {
+			return "", fmt.Errorf("command push: %v", err)
+		}
 
-	c, err := core.CidFromHex(headHash)
+		if oldHash != nil {
+			ff, err := remote.IsFastForward(*oldHash, localRef.Hash())
+			if err != nil {
+				return "", fmt.Errorf("command push: %v", err)
+			}
+			if !ff {
+				return "", core.ErrNonFastForward
+			}
+		}
+	}
+
+	if remote.Options.DryRun {
+		if err := h.startDryRun(remote); err != nil {
+			return "", fmt.Errorf("command push: %v", err)
+		}
+	}
+
+	push := remote.NewPush()
+	push.DryRun = h.dryRun
+	push.NewNode = h.bigNodePatcher(ctx, remote.Tracker)
+	if h.car != nil {
+		patcher := push.NewNode
+		push.NewNode = func(c cid.Cid, data []byte) error {
+			if err := h.car.Put(c, data); err != nil {
+				return err
+			}
+			return patcher(c, data)
+		}
+	}
+	if h.dryRun {
+		// keep the head commit around, linking it into the tree needs its size
+		patcher := push.NewNode
+		push.NewNode = func(c cid.Cid, data []byte) error {
+			if c.Equals(headCid) {
+				if err := h.overlay.PutBlock(c, data); err != nil {
+					return err
+				}
+			}
+			return patcher(c, data)
+		}
+	}
+
+	err = push.PushHash(ctx, headHash)
 	if err != nil {
-		return "", fmt.Errorf("push: %v", err)
+		return "", fmt.Errorf("command push: %v", err)
 	}
 
+	objects, size := push.Stats()
+	h.pushedObjects += objects
+	h.pushedBytes += size
+	h.recoveredObjects += push.Recovered()
+
 	//patch object
-	h.currentHash, err = h.api.PatchLink(h.currentHash, remoteRef, c.String(), true)
+	root, err := h.api.PatchLink(ctx, h.currentHash, remoteRef, headCid.String(), true)
 	if err != nil {
 		return "", fmt.Errorf("push: %v", err)
 	}
 
-	head, err := h.getRef("HEAD")
+	head, err := h.getRef(ctx, "HEAD")
 	if err != nil {
 		return "", fmt.Errorf("push: %v", err)
 	}
 	if head == "" {
-		headRef, err := h.api.Add(strings.NewReader("refs/heads/master")) //TODO: Make this smarter?
+		headRef, err := h.api.Add(ctx, strings.NewReader("refs/heads/master")) //TODO: Make this smarter?
 		if err != nil {
 			return "", fmt.Errorf("push: %v", err)
 		}
 
-		h.currentHash, err = h.api.PatchLink(h.currentHash, "HEAD", headRef, true)
+		root, err = h.api.PatchLink(ctx, root, "HEAD", headRef, true)
 		if err != nil {
 			return "", fmt.Errorf("push: %v", err)
 		}
 	}
 
-	return local, nil
+	// the ref is part of the push only once it is linked in
+	if err := h.recordUpdate(ctx, remoteRef, headCid.String()); err != nil {
+		return "", fmt.Errorf("push: %v", err)
+	}
+	h.currentHash = root
+
+	if !h.dryRun {
+		hash := localRef.Hash()
+		h.pushedRefs[remoteRef] = &hash
+	}
+
+	return remoteRef, nil
+}
+
+// delete removes the ref link from the root directory
+func (h *IpnsHandler) delete(ctx context.Context, remote *core.Remote, remoteRef string) (string, error) {
+	hash, err := h.remoteRefHash(ctx, remoteRef)
+	if err != nil {
+		return "", fmt.Errorf("command push: %v", err)
+	}
+	if hash == nil {
+		return "", core.ErrNoRemoteRef
+	}
+
+	if remote.Options.DryRun {
+		if err := h.startDryRun(remote); err != nil {
+			return "", fmt.Errorf("command push: %v", err)
+		}
+	}
+
+	root, err := h.api.Patch(ctx, h.currentHash, "rm-link", remoteRef)
+	if err != nil {
+		return "", fmt.Errorf("push: %v", err)
+	}
+
+	if err := h.recordUpdate(ctx, remoteRef, ""); err != nil {
+		return "", fmt.Errorf("push: %v", err)
+	}
+	h.currentHash = root
+
+	if !h.dryRun {
+		h.pushedRefs[remoteRef] = nil
+	}
+
+	return remoteRef, nil
+}
+
+// startDryRun makes all further root directory changes happen on an in-memory
+// overlay of the store, so the resulting root can be computed without
+// publishing anything
+func (h *IpnsHandler) startDryRun(remote *core.Remote) error {
+	if h.dryRun {
+		return nil
+	}
+
+	h.overlay = newOverlayStore(remote.Store)
+	api, err := newOfflineAPI(h.overlay)
+	if err != nil {
+		return err
+	}
+
+	h.api = api
+	h.dryRun = true
+	return nil
+}
+
+// remoteRefHash returns the commit a ref currently points to in the pushed
+// tree, or nil if the ref doesn't exist yet
+func (h *IpnsHandler) remoteRefHash(ctx context.Context, ref string) (*plumbing.Hash, error) {
+	refCid, err := h.api.ResolvePath(ctx, path.Join(h.currentHash, ref))
+	if err != nil {
+		if isNoLink(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	c, err := cid.Parse(refCid)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := core.HexFromCid(c)
+	if err != nil {
+		return nil, err
+	}
+
+	out := plumbing.NewHash(hash)
+	return &out, nil
 }
 
 // bigNodePatcher returns a function which patches large object mapping into
 // the resulting object
-func (h *IpnsHandler) bigNodePatcher(tracker *core.Tracker) func(cid.Cid, []byte) error {
+func (h *IpnsHandler) bigNodePatcher(ctx context.Context, tracker *core.Tracker) func(cid.Cid, []byte) error {
 	return func(hash cid.Cid, data []byte) error {
 		if len(data) > (1 << 21) {
-			c, err := h.api.Add(bytes.NewReader(data))
+			c, err := h.api.Add(ctx, bytes.NewReader(data))
 			if err != nil {
 				return err
 			}
 
-			if err := tracker.Set(LOBJ_TRACKER_PRIFIX+"/"+hash.String(), []byte(c)); err != nil {
-				return err
+			if !h.dryRun {
+				if err := tracker.Set(LOBJ_TRACKER_PRIFIX+"/"+hash.String(), []byte(c)); err != nil {
+					return err
+				}
 			}
 
-			h.currentHash, err = h.api.PatchLink(h.currentHash, "objects/"+hash.String(), c, true)
+			h.patchLk.Lock()
+			defer h.patchLk.Unlock()
+
+			root, err := h.api.PatchLink(ctx, h.currentHash, "objects/"+hash.String(), c, true)
 			if err != nil {
 				return err
 			}
+			h.currentHash = root
 		}
 
 		return nil
 	}
 }
 
-func (h *IpnsHandler) fillMissingLobjs(tracker *core.Tracker) error {
+func (h *IpnsHandler) fillMissingLobjs(ctx context.Context, tracker *core.Tracker) error {
 	if h.largeObjs == nil {
-		if err := h.loadObjectMap(); err != nil {
+		if err := h.loadObjectMap(ctx); err != nil {
 			return err
 		}
 	}
@@ -283,17 +668,18 @@ func (h *IpnsHandler) fillMissingLobjs(tracker *core.Tracker) error {
 		k = strings.TrimPrefix(k, LOBJ_TRACKER_PRIFIX+"/")
 
 		h.largeObjs[k] = v
-		h.currentHash, err = h.api.PatchLink(h.currentHash, "objects/"+k, v, true)
+		root, err := h.api.PatchLink(ctx, h.currentHash, "objects/"+k, v, true)
 		if err != nil {
 			return err
 		}
+		h.currentHash = root
 	}
 
 	return nil
 }
 
-func (h *IpnsHandler) getRef(name string) (string, error) {
-	r, err := h.api.Cat(path.Join(h.remoteName, name))
+func (h *IpnsHandler) getRef(ctx context.Context, name string) (string, error) {
+	r, err := h.api.Cat(ctx, path.Join(h.remoteName, name))
 	if err != nil {
 		if isNoLink(err) {
 			return "", nil
@@ -311,8 +697,8 @@ func (h *IpnsHandler) getRef(name string) (string, error) {
 	return buf.String(), nil
 }
 
-func (h *IpnsHandler) paths(api *ipfs.Shell, p string, level int) ([]refPath, error) {
-	links, err := api.List(p)
+func (h *IpnsHandler) paths(ctx context.Context, api ipfsAPI, p string, level int) ([]refPath, error) {
+	links, err := api.List(ctx, p)
 	if err != nil {
 		return nil, err
 	}
@@ -325,7 +711,7 @@ func (h *IpnsHandler) paths(api *ipfs.Shell, p string, level int) ([]refPath, er
 				continue
 			}
 
-			sub, err := h.paths(api, path.Join(p, link.Name), level+1)
+			sub, err := h.paths(ctx, api, path.Join(p, link.Name), level+1)
 			if err != nil {
 				return nil, err
 			}
@@ -8,15 +8,31 @@ package main
 
 import (
 	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	core "github.com/ipfs-shipyard/git-remote-ipld/core"
 	"github.com/ipfs-shipyard/git-remote-ipld/util"
+	ipfs "github.com/ipfs/go-ipfs-api"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
 )
 
 func TestCapabilities(t *testing.T) {
@@ -36,7 +52,7 @@ func TestCapabilities(t *testing.T) {
 		"d5b0d08c180fd7a9bf4f684a37e60ceeb4d25ec8 refs/heads/master",
 	}
 
-	testCase(t, args, "capabilities", []string{"push", "fetch"})
+	testCase(t, args, "capabilities", []string{"push", "fetch", "option"})
 	testCase(t, args, "list", listExp)
 	testCase(t, args, "list for-push", listForPushExp)
 
@@ -67,17 +83,93 @@ func comparePullToMock(t *testing.T, tmpdir, mock string) {
 	wd, _ := os.Getwd()
 	mockdir := filepath.Join(wd, "..", "..", "mock", mock)
 	compareContents(t, filepath.Join(tmpdir, ".git"), mockdir)
+	compareObjects(t, tmpdir, filepath.Join(mockdir, "objects"))
 }
 
 func compareContents(t *testing.T, src, dst string) {
 	src = filepath.Clean(src)
 	dst = filepath.Clean(dst)
-	err := util.CompareDirs(src, dst, []string{"ipld"})
+	err := util.CompareDirs(src, dst, []string{"ipld", "objects"})
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
+// compareObjects checks every loose object of the mock can be read from the
+// repository, fetched objects end up in packs
+func compareObjects(t *testing.T, tmpdir, mockObjects string) {
+	repo, err := git.PlainOpen(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = filepath.Walk(mockObjects, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		dir, name := filepath.Split(p)
+		hash := filepath.Base(dir) + name
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		zr, err := zlib.NewReader(f)
+		if err != nil {
+			return err
+		}
+		expected, err := ioutil.ReadAll(zr)
+		if err != nil {
+			return err
+		}
+
+		obj, err := repo.Storer.EncodedObject(plumbing.AnyObject, plumbing.NewHash(hash))
+		if err != nil {
+			return fmt.Errorf("object %s: %v", hash, err)
+		}
+		r, err := obj.Reader()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+
+		actual := append([]byte(fmt.Sprintf("%s %d\x00", obj.Type(), len(data))), data...)
+		if !bytes.Equal(actual, expected) {
+			return fmt.Errorf("object %s differs from mock", hash)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pushCase runs input against url and returns the helper output along with
+// the url of the root reported by Finish, or url if nothing was pushed
+func pushCase(t *testing.T, url string, input string) (string, string) {
+	var logs, out bytes.Buffer
+	logger := log.New(io.MultiWriter(os.Stderr, &logs), "", 0)
+
+	err := Main([]string{"git-remote-ipld", "origin", url}, strings.NewReader(input+"\n"), &out, logger)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+
+	m := regexp.MustCompile(`ipld://[\w/]+`).FindString(logs.String())
+	if m == "" {
+		return strings.TrimSpace(out.String()), url
+	}
+	return strings.TrimSpace(out.String()), m
+}
+
 func setupTest(t *testing.T) string {
 	wd, _ := os.Getwd()
 	src := filepath.Join(wd, "..", "..", "mock", "git")
@@ -103,3 +195,1301 @@ func setupTest(t *testing.T) string {
 	os.Setenv("GIT_DIR", dst)
 	return tmpdir
 }
+
+func TestOfflineStore(t *testing.T) {
+	tmpdir := setupTest(t)
+	defer os.RemoveAll(tmpdir)
+
+	os.Setenv(STORE_ENV, filepath.Join(tmpdir, "blocks"))
+	defer os.Unsetenv(STORE_ENV)
+
+	// mock/git> git push ipld:// master
+	_, root := pushCase(t, "ipld://", "push refs/heads/master:refs/heads/master\n")
+
+	args := []string{"git-remote-ipld", "origin", root}
+	testCase(t, args, "list", []string{
+		"@refs/heads/master HEAD",
+		"d5b0d08c180fd7a9bf4f684a37e60ceeb4d25ec8 refs/heads/master",
+	})
+
+	// drop objects reachable from master so they have to come from the store
+	for _, obj := range []string{"d5/b0d08c180fd7a9bf4f684a37e60ceeb4d25ec8", "58/1caa0fe56cf01dc028cc0b089d364993e046b6", "98/0a0d5f19a64b4b30a87d4206aade58726b60e3"} {
+		if err := os.Remove(filepath.Join(tmpdir, ".git", "objects", obj)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.RemoveAll(filepath.Join(tmpdir, ".git", "ipld")); err != nil {
+		t.Fatal(err)
+	}
+
+	testCase(t, args, "fetch d5b0d08c180fd7a9bf4f684a37e60ceeb4d25ec8 refs/heads/master\n", []string{""})
+	comparePullToMock(t, tmpdir, "git")
+}
+
+func TestExportCar(t *testing.T) {
+	tmpdir := setupTest(t)
+	defer os.RemoveAll(tmpdir)
+
+	carPath := filepath.Join(tmpdir, "repo.car")
+	os.Setenv(STORE_ENV, filepath.Join(tmpdir, "blocks"))
+	os.Setenv(EXPORT_CAR_ENV, carPath)
+	defer os.Unsetenv(STORE_ENV)
+	defer os.Unsetenv(EXPORT_CAR_ENV)
+
+	args := []string{"git-remote-ipld", "origin", "ipld://"}
+	testCase(t, args, "push refs/heads/master:refs/heads/master\n", []string{"ok refs/heads/master"})
+
+	// the archive alone has to be enough to clone from
+	os.Unsetenv(STORE_ENV)
+	os.Unsetenv(EXPORT_CAR_ENV)
+	if err := os.RemoveAll(filepath.Join(tmpdir, "blocks")); err != nil {
+		t.Fatal(err)
+	}
+
+	args = []string{"git-remote-ipld", "origin", CAR_PREFIX + carPath}
+	testCase(t, args, "list", []string{
+		"@refs/heads/master HEAD",
+		"d5b0d08c180fd7a9bf4f684a37e60ceeb4d25ec8 refs/heads/master",
+	})
+
+	if err := os.RemoveAll(filepath.Join(tmpdir, ".git", "objects", "d5")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(tmpdir, ".git", "ipld")); err != nil {
+		t.Fatal(err)
+	}
+
+	testCase(t, args, "fetch d5b0d08c180fd7a9bf4f684a37e60ceeb4d25ec8 refs/heads/master\n", []string{""})
+	comparePullToMock(t, tmpdir, "git")
+
+	// the fetched objects live in the archive, not in the default store
+	fsckCase := func(args ...string) (string, error) {
+		var logs bytes.Buffer
+		err := Main(append([]string{"git-remote-ipld", "fsck"}, args...), nil, nil, log.New(&logs, "", 0))
+		return logs.String(), err
+	}
+
+	os.Setenv(STORE_ENV, filepath.Join(tmpdir, "blocks"))
+	defer os.Unsetenv(STORE_ENV)
+	if _, err := fsckCase("--"); err == nil {
+		t.Fatal("expected fsck against the default store to report the archive objects")
+	}
+	if logs, err := fsckCase("--remote", CAR_PREFIX+carPath); err != nil {
+		t.Fatalf("fsck against the archive: %v\n%s", err, logs)
+	}
+}
+
+func TestForcePush(t *testing.T) {
+	tmpdir := setupTest(t)
+	defer os.RemoveAll(tmpdir)
+
+	os.Setenv(STORE_ENV, filepath.Join(tmpdir, "blocks"))
+	defer os.Unsetenv(STORE_ENV)
+
+	out, root := pushCase(t, "ipld://", "push refs/heads/french:refs/heads/foo\n")
+	if out != "ok refs/heads/foo" {
+		t.Fatalf("unexpected output %q", out)
+	}
+
+	// italian and french both branch off master
+	out, after := pushCase(t, root, "push refs/heads/italian:refs/heads/foo\n")
+	if out != "error refs/heads/foo non-fast-forward" || after != root {
+		t.Fatalf("unexpected output %q", out)
+	}
+
+	out, after = pushCase(t, root, "push refs/heads/master:refs/heads/foo\n")
+	if out != "error refs/heads/foo non-fast-forward" || after != root {
+		t.Fatalf("unexpected output %q", out)
+	}
+
+	out, after = pushCase(t, root, "push +refs/heads/italian:refs/heads/foo\n")
+	if out != "ok refs/heads/foo" || after == root {
+		t.Fatalf("unexpected output %q", out)
+	}
+
+	testCase(t, []string{"git-remote-ipld", "origin", after}, "list", []string{
+		"@refs/heads/master HEAD",
+		"78a77abd233c24d8e6a0d0d040c79ae569fc7a19 refs/heads/foo",
+	})
+}
+
+func TestDeleteRef(t *testing.T) {
+	tmpdir := setupTest(t)
+	defer os.RemoveAll(tmpdir)
+
+	os.Setenv(STORE_ENV, filepath.Join(tmpdir, "blocks"))
+	defer os.Unsetenv(STORE_ENV)
+
+	_, root := pushCase(t, "ipld://", "push refs/heads/master:refs/heads/master\npush refs/heads/french:refs/heads/foo\n")
+
+	out, root := pushCase(t, root, "push :refs/heads/foo\n")
+	if out != "ok refs/heads/foo" {
+		t.Fatalf("unexpected output %q", out)
+	}
+
+	testCase(t, []string{"git-remote-ipld", "origin", root}, "list", []string{
+		"@refs/heads/master HEAD",
+		"d5b0d08c180fd7a9bf4f684a37e60ceeb4d25ec8 refs/heads/master",
+	})
+
+	out, _ = pushCase(t, root, "push :refs/heads/foo\n")
+	if out != "error refs/heads/foo remote ref does not exist" {
+		t.Fatalf("unexpected output %q", out)
+	}
+}
+
+func TestPushReportsPerRef(t *testing.T) {
+	tmpdir := setupTest(t)
+	defer os.RemoveAll(tmpdir)
+
+	os.Setenv(STORE_ENV, filepath.Join(tmpdir, "blocks"))
+	defer os.Unsetenv(STORE_ENV)
+
+	_, root := pushCase(t, "ipld://", "push refs/heads/french:refs/heads/foo\n")
+
+	out, root := pushCase(t, root, "push refs/heads/italian:refs/heads/foo\npush refs/heads/nope:refs/heads/nope\npush refs/heads/master:refs/heads/master\n")
+	exp := strings.Join([]string{
+		"error refs/heads/foo non-fast-forward",
+		"error refs/heads/nope command push: reference not found",
+		"ok refs/heads/master",
+	}, "\n")
+	if out != exp {
+		t.Fatalf("Expected:\n%s\nActual:\n%s", exp, out)
+	}
+
+	testCase(t, []string{"git-remote-ipld", "origin", root}, "list", []string{
+		"@refs/heads/master HEAD",
+		"162429cc0dac923dff140ec29247f42a8e362419 refs/heads/foo",
+		"d5b0d08c180fd7a9bf4f684a37e60ceeb4d25ec8 refs/heads/master",
+	})
+}
+
+func TestOptions(t *testing.T) {
+	tmpdir := setupTest(t)
+	defer os.RemoveAll(tmpdir)
+
+	os.Setenv(STORE_ENV, filepath.Join(tmpdir, "blocks"))
+	defer os.Unsetenv(STORE_ENV)
+
+	args := []string{"git-remote-ipld", "origin", "ipld://"}
+	testCase(t, args, "option verbosity 2", []string{"ok"})
+	testCase(t, args, "option progress false", []string{"ok"})
+	testCase(t, args, "option depth x", []string{`error invalid value for depth: "x"`})
+	testCase(t, args, "option deepen-since 2018-02-01", []string{"ok"})
+	testCase(t, args, "option deepen-since yesterday", []string{`error invalid value for deepen-since: "yesterday"`})
+	testCase(t, args, "option cloning true", []string{"unsupported"})
+
+}
+
+func TestShallowFetch(t *testing.T) {
+	tmpdir := setupTest(t)
+	defer os.RemoveAll(tmpdir)
+
+	os.Setenv(STORE_ENV, filepath.Join(tmpdir, "blocks"))
+	defer os.Unsetenv(STORE_ENV)
+
+	_, root := pushCase(t, "ipld://", "push refs/heads/french:refs/heads/french\n")
+
+	// drop french and its parent so both would have to be fetched
+	objects := filepath.Join(tmpdir, ".git", "objects")
+	for _, obj := range []string{"16/2429cc0dac923dff140ec29247f42a8e362419", "31/f087b9bf39d5bcbba5d4e80b2b4ff19a71dc00"} {
+		if err := os.Remove(filepath.Join(objects, obj)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.RemoveAll(filepath.Join(tmpdir, ".git", "ipld")); err != nil {
+		t.Fatal(err)
+	}
+
+	args := []string{"git-remote-ipld", "origin", root}
+	testCase(t, args, "option depth 1\nfetch 162429cc0dac923dff140ec29247f42a8e362419 refs/heads/french\n", []string{"ok"})
+
+	repo, err := git.PlainOpen(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Storer.EncodedObject(plumbing.CommitObject, plumbing.NewHash("162429cc0dac923dff140ec29247f42a8e362419")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Storer.EncodedObject(plumbing.CommitObject, plumbing.NewHash("31f087b9bf39d5bcbba5d4e80b2b4ff19a71dc00")); err != plumbing.ErrObjectNotFound {
+		t.Fatalf("parent beyond depth was fetched: %v", err)
+	}
+
+	shallow, err := ioutil.ReadFile(filepath.Join(tmpdir, ".git", "shallow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(shallow) != "162429cc0dac923dff140ec29247f42a8e362419\n" {
+		t.Fatalf("unexpected shallow file %q", shallow)
+	}
+
+	// deepening walks the cut off commit again and fetches its parent
+	testCase(t, args, "option depth 2147483647\nfetch 162429cc0dac923dff140ec29247f42a8e362419 refs/heads/french\n", []string{"ok"})
+
+	repo, err = git.PlainOpen(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Storer.EncodedObject(plumbing.CommitObject, plumbing.NewHash("31f087b9bf39d5bcbba5d4e80b2b4ff19a71dc00")); err != nil {
+		t.Fatalf("parent wasn't fetched when deepening: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpdir, ".git", "shallow")); !os.IsNotExist(err) {
+		t.Fatalf("shallow file left after fetching full history: %v", err)
+	}
+}
+
+func TestDeepenSinceUnshallow(t *testing.T) {
+	tmpdir := setupTest(t)
+	defer os.RemoveAll(tmpdir)
+
+	os.Setenv(STORE_ENV, filepath.Join(tmpdir, "blocks"))
+	defer os.Unsetenv(STORE_ENV)
+
+	_, root := pushCase(t, "ipld://", "push refs/heads/french:refs/heads/french\n")
+
+	objects := filepath.Join(tmpdir, ".git", "objects")
+	for _, obj := range []string{"16/2429cc0dac923dff140ec29247f42a8e362419", "31/f087b9bf39d5bcbba5d4e80b2b4ff19a71dc00"} {
+		if err := os.Remove(filepath.Join(objects, obj)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.RemoveAll(filepath.Join(tmpdir, ".git", "ipld")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the parent was committed before the cut, it is skipped
+	args := []string{"git-remote-ipld", "origin", root}
+	testCase(t, args, "option deepen-since 1517945720\nfetch 162429cc0dac923dff140ec29247f42a8e362419 refs/heads/french\n", []string{"ok"})
+
+	shallow, err := ioutil.ReadFile(filepath.Join(tmpdir, ".git", "shallow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(shallow) != "162429cc0dac923dff140ec29247f42a8e362419\n" {
+		t.Fatalf("unexpected shallow file %q", shallow)
+	}
+
+	// the skipped parent mustn't be taken for present when unshallowing
+	testCase(t, args, "option depth 2147483647\nfetch 162429cc0dac923dff140ec29247f42a8e362419 refs/heads/french\n", []string{"ok"})
+
+	repo, err := git.PlainOpen(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Storer.EncodedObject(plumbing.CommitObject, plumbing.NewHash("31f087b9bf39d5bcbba5d4e80b2b4ff19a71dc00")); err != nil {
+		t.Fatalf("skipped parent wasn't fetched when unshallowing: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpdir, ".git", "shallow")); !os.IsNotExist(err) {
+		t.Fatalf("shallow file left after fetching full history: %v", err)
+	}
+}
+
+func TestJobsConfig(t *testing.T) {
+	tmpdir := setupTest(t)
+	defer os.RemoveAll(tmpdir)
+
+	os.Setenv(STORE_ENV, filepath.Join(tmpdir, "blocks"))
+	defer os.Unsetenv(STORE_ENV)
+
+	args := []string{"git-remote-ipld", "origin", "ipld://"}
+
+	cfg, err := os.OpenFile(filepath.Join(tmpdir, ".git", "config"), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.WriteString("[ipld]\n\tfetchJobs = 4\n\tpushJobs = lots\n")
+	cfg.Close()
+
+	err = Main(args, strings.NewReader("\n"), ioutil.Discard, log.New(ioutil.Discard, "", 0))
+	if err == nil || !strings.Contains(err.Error(), "ipld.pushJobs") {
+		t.Fatalf("expected config error, got %v", err)
+	}
+
+	// the environment takes precedence
+	os.Setenv(core.PUSH_JOBS_ENV, "2")
+	defer os.Unsetenv(core.PUSH_JOBS_ENV)
+	testCase(t, args, "push refs/heads/master:refs/heads/master\n", []string{"ok refs/heads/master"})
+
+	// settings outside of the repository apply too
+	global := filepath.Join(tmpdir, "gitconfig")
+	if err := ioutil.WriteFile(global, []byte("[ipld]\n\tblockTimeout = forever\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("GIT_CONFIG_GLOBAL", global)
+	defer os.Unsetenv("GIT_CONFIG_GLOBAL")
+
+	err = Main(args, strings.NewReader("\n"), ioutil.Discard, log.New(ioutil.Discard, "", 0))
+	if err == nil || !strings.Contains(err.Error(), "ipld.blockTimeout") {
+		t.Fatalf("expected global config error, got %v", err)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	tmpdir := setupTest(t)
+	defer os.RemoveAll(tmpdir)
+
+	blocks := filepath.Join(tmpdir, "blocks")
+	os.Setenv(STORE_ENV, blocks)
+	defer os.Unsetenv(STORE_ENV)
+
+	var logs, out bytes.Buffer
+	logger := log.New(io.MultiWriter(os.Stderr, &logs), "", 0)
+	input := "option dry-run true\npush refs/heads/master:refs/heads/master\n\n"
+	err := Main([]string{"git-remote-ipld", "origin", "ipld://"}, strings.NewReader(input), &out, logger)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+
+	if strings.TrimSpace(out.String()) != "ok\nok refs/heads/master" {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+	if !strings.Contains(logs.String(), "would push 3 objects") {
+		t.Fatalf("no dry-run summary in %q", logs.String())
+	}
+
+	// nothing may have been stored
+	if entries, _ := ioutil.ReadDir(blocks); len(entries) != 0 {
+		t.Fatalf("dry-run stored %d block shards", len(entries))
+	}
+
+	// the reported root has to match the real push
+	_, dryRoot := pushCase(t, "ipld://", "option dry-run true\npush refs/heads/master:refs/heads/master\n")
+	_, root := pushCase(t, "ipld://", "push refs/heads/master:refs/heads/master\n")
+	if dryRoot != root {
+		t.Fatalf("dry-run root %s != %s", dryRoot, root)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	tmpdir := setupTest(t)
+	defer os.RemoveAll(tmpdir)
+
+	blocks := filepath.Join(tmpdir, "blocks")
+	os.Setenv(STORE_ENV, blocks)
+	defer os.Unsetenv(STORE_ENV)
+
+	pushCase(t, "ipld://", "push refs/heads/master:refs/heads/master\n")
+
+	fsckCase := func(args ...string) (string, error) {
+		var logs bytes.Buffer
+		err := Main(append([]string{"git-remote-ipld", "fsck"}, args...), nil, nil, log.New(&logs, "", 0))
+		return logs.String(), err
+	}
+
+	if logs, err := fsckCase("--"); err != nil {
+		t.Fatalf("fsck of a fresh push: %v\n%s", err, logs)
+	}
+
+	// garbage collected by the daemon
+	const blob = "980a0d5f19a64b4b30a87d4206aade58726b60e3"
+	c, err := core.CidFromHex(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := c.String()
+	if err := os.Remove(filepath.Join(blocks, key[len(key)-3:len(key)-1], key)); err != nil {
+		t.Fatal(err)
+	}
+
+	logs, err := fsckCase("--")
+	if err == nil {
+		t.Fatal("expected fsck to report the missing block")
+	}
+	if !strings.Contains(logs, "stale "+blob+": missing from block store") {
+		t.Fatalf("stale entry not reported:\n%s", logs)
+	}
+
+	if logs, err := fsckCase("--repair"); err != nil {
+		t.Fatalf("repair: %v\n%s", err, logs)
+	}
+
+	tracker, err := core.NewTracker(filepath.Join(tmpdir, ".git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the blob and everything reaching it has to be pushed again
+	for _, hash := range []string{blob, "581caa0fe56cf01dc028cc0b089d364993e046b6", "d5b0d08c180fd7a9bf4f684a37e60ceeb4d25ec8"} {
+		h := plumbing.NewHash(hash)
+		if has, err := tracker.HasEntry(h[:]); err != nil || has {
+			t.Fatalf("%s still tracked: %v", hash, err)
+		}
+	}
+	if err := tracker.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pushCase(t, "ipld://", "push refs/heads/master:refs/heads/master\n")
+	if logs, err := fsckCase("--"); err != nil {
+		t.Fatalf("fsck after pushing again: %v\n%s", err, logs)
+	}
+}
+
+func TestRemoteNamedFsck(t *testing.T) {
+	tmpdir := setupTest(t)
+	defer os.RemoveAll(tmpdir)
+
+	os.Setenv(STORE_ENV, filepath.Join(tmpdir, "blocks"))
+	defer os.Unsetenv(STORE_ENV)
+
+	_, root := pushCase(t, "ipld://", "push refs/heads/master:refs/heads/master\n")
+
+	cfg, err := os.OpenFile(filepath.Join(tmpdir, ".git", "config"), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(cfg, "[remote \"fsck\"]\n\turl = %s\n", root)
+	cfg.Close()
+
+	// git runs the helper for the remote, with and without the url
+	for _, args := range [][]string{{"git-remote-ipld", "fsck"}, {"git-remote-ipld", "fsck", root}} {
+		var out bytes.Buffer
+		if err := Main(args, strings.NewReader("list\n\n"), &out, log.New(ioutil.Discard, "", 0)); err != nil && err != io.EOF {
+			t.Fatalf("%v: %v", args, err)
+		}
+		if !strings.Contains(out.String(), " refs/heads/master\n") {
+			t.Fatalf("%v: expected refs of the remote, got %q", args, out.String())
+		}
+	}
+}
+
+func TestBigNodesInParallel(t *testing.T) {
+	tmpdir := setupTest(t)
+	defer os.RemoveAll(tmpdir)
+
+	store, err := core.NewFileStore(filepath.Join(tmpdir, "blocks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, err := newOfflineAPI(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker, err := core.NewTracker(filepath.Join(tmpdir, ".git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.Close()
+
+	h := &IpnsHandler{api: api, remoteName: EMPTY_REPO, currentHash: EMPTY_REPO, gitRemote: "origin"}
+	patch := h.bigNodePatcher(context.Background(), tracker)
+
+	// push stores objects from several goroutines, none of the links may
+	// get lost
+	const objects = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, objects)
+	for i := 0; i < objects; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 1<<21+1)
+		c, err := core.CidFromHex(plumbing.ComputeHash(plumbing.BlobObject, data).String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- patch(c, data)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links, err := api.List(context.Background(), h.currentHash+"/"+LARGE_OBJECT_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != objects {
+		t.Fatalf("expected %d large objects, got %d", objects, len(links))
+	}
+}
+
+// pinRecorder keeps pins in memory, like a daemon would
+type pinRecorder struct {
+	ipfsAPI
+	pinned map[string]bool
+}
+
+func (r *pinRecorder) Pin(ctx context.Context, p string) error {
+	r.pinned[p] = true
+	return nil
+}
+
+func (r *pinRecorder) Unpin(ctx context.Context, p string) error {
+	if !r.pinned[p] {
+		return fmt.Errorf("%s is not pinned", p)
+	}
+	delete(r.pinned, p)
+	return nil
+}
+
+func TestPinRetention(t *testing.T) {
+	tmpdir := setupTest(t)
+	defer os.RemoveAll(tmpdir)
+
+	os.Setenv(PIN_KEEP_ENV, "2")
+	defer os.Unsetenv(PIN_KEEP_ENV)
+
+	store, err := core.NewFileStore(filepath.Join(tmpdir, "blocks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, err := newOfflineAPI(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &pinRecorder{ipfsAPI: api, pinned: map[string]bool{}}
+	h := &IpnsHandler{api: rec, remoteName: EMPTY_REPO, gitRemote: "origin"}
+	remote, err := core.NewRemote(context.Background(), h, store, strings.NewReader(""), ioutil.Discard, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+
+	// pushing the same root again doesn't count twice
+	for _, root := range []string{"root1", "root2", "root2", "root3"} {
+		if err := h.pinRoot(context.Background(), remote, root); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(rec.pinned) != 2 || !rec.pinned["root3"] || !rec.pinned["root2"] {
+		t.Fatalf("expected the last two roots pinned, got %v", rec.pinned)
+	}
+
+	pins, err := remote.Tracker.Get(PIN_TRACKER_PREFIX + "/origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pins) != "root3\nroot2" {
+		t.Fatalf("unexpected pinned roots %q", pins)
+	}
+
+	os.Setenv(PIN_ENV, "false")
+	defer os.Unsetenv(PIN_ENV)
+	if err := h.pinRoot(context.Background(), remote, "root4"); err != nil {
+		t.Fatal(err)
+	}
+	if rec.pinned["root4"] {
+		t.Fatal("pinned with pinning disabled")
+	}
+	os.Unsetenv(PIN_ENV)
+
+	// pushes to ad-hoc urls are unrelated, none of them is unpinned
+	h.gitRemote = "ipld://"
+	for _, root := range []string{"adhoc1", "adhoc2", "adhoc3"} {
+		if err := h.pinRoot(context.Background(), remote, root); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !rec.pinned["adhoc1"] || !rec.pinned["adhoc2"] || !rec.pinned["adhoc3"] || !rec.pinned["root2"] {
+		t.Fatalf("ad-hoc push unpinned roots, got %v", rec.pinned)
+	}
+	if pins, err := remote.Tracker.Get(PIN_TRACKER_PREFIX + "/ipld://"); err != nil || pins != nil {
+		t.Fatalf("pins of an ad-hoc url recorded %q: %v", pins, err)
+	}
+}
+
+func TestPinServiceRetention(t *testing.T) {
+	tmpdir := setupTest(t)
+	defer os.RemoveAll(tmpdir)
+
+	// stand-in pinning service, requests are pinned by the first poll unless
+	// the service is stuck
+	var lk sync.Mutex
+	pins := map[string]string{}
+	requests := 0
+	stuck := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lk.Lock()
+		defer lk.Unlock()
+
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		id := strings.TrimPrefix(r.URL.Path, "/pins/")
+		switch r.Method {
+		case http.MethodPost:
+			var pin core.Pin
+			json.NewDecoder(r.Body).Decode(&pin)
+			requests++
+			id = fmt.Sprintf("req%d", requests)
+			pins[id] = pin.Cid
+			json.NewEncoder(w).Encode(core.PinStatus{RequestID: id, Status: core.PinQueued, Pin: pin})
+		case http.MethodGet:
+			status := core.PinPinned
+			if stuck {
+				status = core.PinQueued
+			}
+			json.NewEncoder(w).Encode(core.PinStatus{RequestID: id, Status: status, Pin: core.Pin{Cid: pins[id]}})
+		case http.MethodDelete:
+			delete(pins, id)
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}))
+	defer srv.Close()
+
+	store, err := core.NewFileStore(filepath.Join(tmpdir, "blocks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, err := newOfflineAPI(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &IpnsHandler{api: api, remoteName: EMPTY_REPO, gitRemote: "origin"}
+	remote, err := core.NewRemote(context.Background(), h, store, strings.NewReader(""), ioutil.Discard, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+
+	cfg, err := remote.Repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Raw.Section("ipld").Subsection("origin").
+		SetOption("pinService", srv.URL).
+		SetOption("pinServiceToken", "secret")
+	cfg.Raw.Section("ipld").SetOption("pinKeep", "2")
+	if err := remote.Repo.Storer.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, root := range []string{"root1", "root2", "root3"} {
+		if err := h.pinRemote(context.Background(), remote, root); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(pins) != 2 || pins["req2"] != "root2" || pins["req3"] != "root3" {
+		t.Fatalf("expected the last two roots pinned, got %v", pins)
+	}
+
+	// a request still queued may fail, nothing older is removed for it
+	os.Setenv(PIN_SERVICE_WAIT_ENV, "50ms")
+	defer os.Unsetenv(PIN_SERVICE_WAIT_ENV)
+	lk.Lock()
+	stuck = true
+	lk.Unlock()
+	if err := h.pinRemote(context.Background(), remote, "root4"); err != nil {
+		t.Fatal(err)
+	}
+	if len(pins) != 3 || pins["req2"] != "root2" || pins["req3"] != "root3" {
+		t.Fatalf("pins removed for a queued request, got %v", pins)
+	}
+
+	// once a later pin is confirmed the old ones go
+	lk.Lock()
+	stuck = false
+	lk.Unlock()
+	os.Unsetenv(PIN_SERVICE_WAIT_ENV)
+	if err := h.pinRemote(context.Background(), remote, "root5"); err != nil {
+		t.Fatal(err)
+	}
+	if len(pins) != 2 || pins["req4"] != "root4" || pins["req5"] != "root5" {
+		t.Fatalf("expected the last two roots pinned, got %v", pins)
+	}
+}
+
+func TestIpnsRemote(t *testing.T) {
+	tmpdir := setupTest(t)
+	defer os.RemoveAll(tmpdir)
+
+	os.Setenv(STORE_ENV, filepath.Join(tmpdir, "blocks"))
+	defer os.Unsetenv(STORE_ENV)
+
+	const url = "ipns://myrepo"
+	args := []string{"git-remote-ipld", "origin", url}
+
+	// never published, starts out empty
+	testCase(t, args, "list", []string{})
+
+	out, root := pushCase(t, url, "push refs/heads/master:refs/heads/master\n")
+	if out != "ok refs/heads/master" || root == url {
+		t.Fatalf("unexpected output %q", out)
+	}
+
+	testCase(t, args, "list", []string{
+		"@refs/heads/master HEAD",
+		"d5b0d08c180fd7a9bf4f684a37e60ceeb4d25ec8 refs/heads/master",
+	})
+
+	// the name follows further pushes, the old root stays as it was
+	_, next := pushCase(t, url, "push refs/heads/french:refs/heads/french\n")
+	if next == root {
+		t.Fatal("root didn't change")
+	}
+
+	testCase(t, args, "list", []string{
+		"@refs/heads/master HEAD",
+		"162429cc0dac923dff140ec29247f42a8e362419 refs/heads/french",
+		"d5b0d08c180fd7a9bf4f684a37e60ceeb4d25ec8 refs/heads/master",
+	})
+	testCase(t, []string{"git-remote-ipld", "origin", root}, "list", []string{
+		"@refs/heads/master HEAD",
+		"d5b0d08c180fd7a9bf4f684a37e60ceeb4d25ec8 refs/heads/master",
+	})
+}
+
+// failingResolveAPI fails every resolve with err
+type failingResolveAPI struct {
+	*offlineAPI
+	err error
+}
+
+func (f *failingResolveAPI) Resolve(ctx context.Context, name string, nocache bool) (string, error) {
+	return "", f.err
+}
+
+func TestIpnsUnresolved(t *testing.T) {
+	tmpdir := setupTest(t)
+	defer os.RemoveAll(tmpdir)
+
+	store, err := core.NewFileStore(filepath.Join(tmpdir, "blocks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, err := newOfflineAPI(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.names = filepath.Join(tmpdir, "blocks", "ipns")
+
+	initialize := func(err error) (*IpnsHandler, error) {
+		h := &IpnsHandler{api: &failingResolveAPI{api, err}, remoteName: EMPTY_REPO, gitRemote: "origin", ipnsName: "myrepo"}
+		remote, err := core.NewRemote(context.Background(), h, store, strings.NewReader(""), ioutil.Discard, log.New(ioutil.Discard, "", 0))
+		if err != nil {
+			return nil, err
+		}
+		return h, remote.Close()
+	}
+
+	// a local key which was never published starts out empty
+	h, err := initialize(&ipfs.Error{Command: "name/resolve", Message: "could not resolve name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.remoteName != EMPTY_REPO {
+		t.Fatalf("expected an empty repository, got %s", h.remoteName)
+	}
+
+	// other failures may hide a published root
+	for _, failure := range []error{
+		&ipfs.Error{Command: "name/resolve", Message: "routing: context deadline exceeded"},
+		errors.New("connection refused"),
+	} {
+		if _, err := initialize(failure); err == nil {
+			t.Fatalf("expected %v to fail the remote", failure)
+		}
+	}
+
+	// a configured key has to be the one of the name
+	os.Setenv(IPNS_KEY_ENV, "otherkey")
+	defer os.Unsetenv(IPNS_KEY_ENV)
+	_, err = initialize(&ipfs.Error{Command: "name/resolve", Message: "could not resolve name"})
+	if err == nil || !strings.Contains(err.Error(), "doesn't publish") {
+		t.Fatalf("expected a key mismatch, got %v", err)
+	}
+}
+
+// racingAPI publishes a competing root right before the name is resolved
+type racingAPI struct {
+	*offlineAPI
+	race func(root string) string
+
+	// published counts roots published by the push
+	published int
+}
+
+func (r *racingAPI) PublishWithDetails(ctx context.Context, contentHash, key string, lifetime, ttl time.Duration, resolve bool) (*ipfs.PublishResponse, error) {
+	r.published++
+	return r.offlineAPI.PublishWithDetails(ctx, contentHash, key, lifetime, ttl, resolve)
+}
+
+func (r *racingAPI) Resolve(ctx context.Context, name string, nocache bool) (string, error) {
+	if r.race != nil {
+		p, err := r.offlineAPI.Resolve(ctx, name, nocache)
+		if err != nil {
+			return "", err
+		}
+
+		root := r.race(strings.TrimPrefix(p, "/ipfs/"))
+		r.race = nil
+		if _, err := r.offlineAPI.PublishWithDetails(ctx, "/ipfs/"+root, name, 0, 0, false); err != nil {
+			return "", err
+		}
+	}
+	return r.offlineAPI.Resolve(ctx, name, nocache)
+}
+
+func TestIpnsConcurrentPush(t *testing.T) {
+	tmpdir := setupTest(t)
+	defer os.RemoveAll(tmpdir)
+
+	dir := filepath.Join(tmpdir, "blocks")
+	os.Setenv(STORE_ENV, dir)
+	defer os.Unsetenv(STORE_ENV)
+
+	const url = "ipns://myrepo"
+	if out, _ := pushCase(t, url, "push refs/heads/master:refs/heads/master\n"); out != "ok refs/heads/master" {
+		t.Fatalf("unexpected output %q", out)
+	}
+
+	master, err := core.CidFromHex("d5b0d08c180fd7a9bf4f684a37e60ceeb4d25ec8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// push input while someone else links master as ref in between
+	var published int
+	racePush := func(input, ref string) string {
+		store, err := core.NewFileStore(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		api, err := newOfflineAPI(store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		api.names = filepath.Join(dir, "ipns")
+
+		var out bytes.Buffer
+		rec := &racingAPI{offlineAPI: api}
+		h := &IpnsHandler{api: rec, remoteName: EMPTY_REPO, gitRemote: "origin", ipnsName: "myrepo"}
+		remote, err := core.NewRemote(context.Background(), h, store, strings.NewReader(input+"\n"), &out, log.New(ioutil.Discard, "", 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer remote.Close()
+
+		rec.race = func(root string) string {
+			root, err := api.PatchLink(context.Background(), root, ref, master.String(), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return root
+		}
+		if err := remote.ProcessCommands(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		published = rec.published
+		return out.String()
+	}
+
+	// other refs were updated, ours are replayed on top
+	if out := racePush("push refs/heads/french:refs/heads/french\n", "refs/heads/other"); out != "ok refs/heads/french\n\n" {
+		t.Fatalf("unexpected output %q", out)
+	}
+
+	args := []string{"git-remote-ipld", "origin", url}
+	testCase(t, args, "list", []string{
+		"@refs/heads/master HEAD",
+		"162429cc0dac923dff140ec29247f42a8e362419 refs/heads/french",
+		"d5b0d08c180fd7a9bf4f684a37e60ceeb4d25ec8 refs/heads/master",
+		"d5b0d08c180fd7a9bf4f684a37e60ceeb4d25ec8 refs/heads/other",
+	})
+
+	// the same ref was updated, only the other one is published
+	out := racePush("push refs/heads/french:refs/heads/topic\npush refs/heads/french:refs/heads/next\n", "refs/heads/topic")
+	if out != "error refs/heads/topic fetch first\nok refs/heads/next\n\n" {
+		t.Fatalf("expected a conflict, got %q", out)
+	}
+
+	testCase(t, args, "list", []string{
+		"@refs/heads/master HEAD",
+		"162429cc0dac923dff140ec29247f42a8e362419 refs/heads/french",
+		"d5b0d08c180fd7a9bf4f684a37e60ceeb4d25ec8 refs/heads/master",
+		"162429cc0dac923dff140ec29247f42a8e362419 refs/heads/next",
+		"d5b0d08c180fd7a9bf4f684a37e60ceeb4d25ec8 refs/heads/other",
+		"d5b0d08c180fd7a9bf4f684a37e60ceeb4d25ec8 refs/heads/topic",
+	})
+
+	// nothing is published when every ref conflicts
+	out = racePush("push refs/heads/french:refs/heads/last\n", "refs/heads/last")
+	if out != "error refs/heads/last fetch first\n\n" || published != 0 {
+		t.Fatalf("expected a conflict without publishing, got %q and %d publishes", out, published)
+	}
+}
+
+// flakyResolveAPI claims the name is unpublished after the first resolve
+type flakyResolveAPI struct {
+	*offlineAPI
+	calls int
+}
+
+func (f *flakyResolveAPI) Resolve(ctx context.Context, name string, nocache bool) (string, error) {
+	f.calls++
+	if f.calls > 1 {
+		return "", &ipfs.Error{Command: "name/resolve", Message: "could not resolve name"}
+	}
+	return f.offlineAPI.Resolve(ctx, name, nocache)
+}
+
+func TestIpnsFlakyResolve(t *testing.T) {
+	tmpdir := setupTest(t)
+	defer os.RemoveAll(tmpdir)
+
+	dir := filepath.Join(tmpdir, "blocks")
+	os.Setenv(STORE_ENV, dir)
+	defer os.Unsetenv(STORE_ENV)
+
+	const url = "ipns://myrepo"
+	if out, _ := pushCase(t, url, "push refs/heads/master:refs/heads/master\n"); out != "ok refs/heads/master" {
+		t.Fatalf("unexpected output %q", out)
+	}
+
+	store, err := core.NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, err := newOfflineAPI(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.names = filepath.Join(dir, "ipns")
+
+	// the name was published, a failing resolve mustn't start it over
+	var out bytes.Buffer
+	h := &IpnsHandler{api: &flakyResolveAPI{offlineAPI: api}, remoteName: EMPTY_REPO, gitRemote: "origin", ipnsName: "myrepo"}
+	input := "push refs/heads/french:refs/heads/french\n\n"
+	remote, err := core.NewRemote(context.Background(), h, store, strings.NewReader(input), &out, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.ProcessCommands(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "error refs/heads/french resolve ipns://myrepo") {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+
+	testCase(t, []string{"git-remote-ipld", "origin", url}, "list", []string{
+		"@refs/heads/master HEAD",
+		"d5b0d08c180fd7a9bf4f684a37e60ceeb4d25ec8 refs/heads/master",
+	})
+}
+
+// failingPublishAPI can't publish names
+type failingPublishAPI struct {
+	*offlineAPI
+}
+
+func (f *failingPublishAPI) PublishWithDetails(ctx context.Context, contentHash, key string, lifetime, ttl time.Duration, resolve bool) (*ipfs.PublishResponse, error) {
+	return nil, errors.New("routing: no peers")
+}
+
+func TestIpnsPublishFailure(t *testing.T) {
+	tmpdir := setupTest(t)
+	defer os.RemoveAll(tmpdir)
+
+	store, err := core.NewFileStore(filepath.Join(tmpdir, "blocks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, err := newOfflineAPI(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.names = filepath.Join(tmpdir, "blocks", "ipns")
+
+	var out bytes.Buffer
+	h := &IpnsHandler{api: &failingPublishAPI{api}, remoteName: EMPTY_REPO, gitRemote: "origin", ipnsName: "myrepo"}
+	input := "push refs/heads/master:refs/heads/master\n\n"
+	remote, err := core.NewRemote(context.Background(), h, store, strings.NewReader(input), &out, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+
+	if err := remote.ProcessCommands(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "error refs/heads/master publish ipns://myrepo: routing: no peers\n\n" {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+
+	// the ref wasn't pushed as far as the tracker is concerned
+	if hash, err := remote.Tracker.Get("refs/heads/master"); err != nil || hash != nil {
+		t.Fatalf("tracker ref advanced to %x: %v", hash, err)
+	}
+}
+
+// txtRecords is a stand-in dns resolver
+type txtRecords map[string][]string
+
+func (r txtRecords) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, ok := r[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+func TestDNSLink(t *testing.T) {
+	tmpdir := setupTest(t)
+	defer os.RemoveAll(tmpdir)
+
+	os.Setenv(STORE_ENV, filepath.Join(tmpdir, "blocks"))
+	defer os.Unsetenv(STORE_ENV)
+
+	_, root := pushCase(t, "ipld://", "push refs/heads/master:refs/heads/master\n")
+	root = strings.TrimPrefix(root, IPLD_PREFIX)
+
+	// the same repository further down a site
+	store, err := core.NewFileStore(filepath.Join(tmpdir, "blocks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, err := newOfflineAPI(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	site, err := api.PatchLink(context.Background(), EMPTY_REPO, "repos/git", root, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := txtRecords{
+		"_dnslink.git.example.org": {"v=spf1 -all", "dnslink=/ipfs/" + root},
+		"git.example.org":          {"dnslink=/ipfs/" + EMPTY_REPO},
+		"site.example.org":         {"dnslink=/ipfs/" + site + "/repos/git"},
+		"repos.example.org":        {"dnslink=/ipfs/" + site + "/repos"},
+		"bad.example.org":          {"dnslink=/ipns/example.org"},
+		"unclean.example.org":      {"dnslink=/ipfs/" + site + "/repos/../git"},
+	}
+	defer func(r txtResolver) { dnsResolver = r }(dnsResolver)
+	dnsResolver = records
+
+	// a path in the record comes before the one in the url
+	for _, url := range []string{"ipld://dnslink/git.example.org", "ipld://dnslink/site.example.org", "ipld://dnslink/repos.example.org/git"} {
+		testCase(t, []string{"git-remote-ipld", "origin", url}, "list", []string{
+			"@refs/heads/master HEAD",
+			"d5b0d08c180fd7a9bf4f684a37e60ceeb4d25ec8 refs/heads/master",
+		})
+	}
+
+	for domain, expected := range map[string]string{
+		"bad.example.org":     "unsupported record",
+		"unclean.example.org": "unclean path",
+		"missing.example.org": "no dnslink record found",
+	} {
+		err := Main([]string{"git-remote-ipld", "origin", "ipld://dnslink/" + domain}, strings.NewReader("list\n"), ioutil.Discard, log.New(ioutil.Discard, "", 0))
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: expected %q error, got %v", domain, expected, err)
+		}
+	}
+
+	// lookups give up after the block timeout
+	os.Setenv(core.BLOCK_TIMEOUT_ENV, "100ms")
+	defer os.Unsetenv(core.BLOCK_TIMEOUT_ENV)
+	dnsResolver = hungResolver{}
+	err = Main([]string{"git-remote-ipld", "origin", "ipld://dnslink/git.example.org"}, strings.NewReader("list\n"), ioutil.Discard, log.New(ioutil.Discard, "", 0))
+	if err == nil || !strings.Contains(err.Error(), "deadline exceeded") {
+		t.Fatalf("expected the lookup to time out, got %v", err)
+	}
+}
+
+// hungResolver never answers
+type hungResolver struct{}
+
+func (hungResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestParseURL(t *testing.T) {
+	const c = "QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn"
+
+	for raw, expected := range map[string]*remoteURL{
+		"ipld://":                         {kind: ipldRemote},
+		"ipfs://":                         {kind: ipldRemote},
+		"ipld://" + c:                     {kind: ipldRemote, root: c},
+		"ipfs://" + c + "/":               {kind: ipldRemote, root: c},
+		"ipfs://" + c + "/repos/foo":      {kind: ipldRemote, root: c, subpath: "repos/foo"},
+		"/ipfs/" + c + "/repos/foo":       {kind: ipldRemote, root: c, subpath: "repos/foo"},
+		c:                                 {kind: ipldRemote, root: c},
+		c + "/foo":                        {kind: ipldRemote, root: c, subpath: "foo"},
+		"ipns://myrepo":                   {kind: ipnsRemote, root: "myrepo"},
+		"/ipns/example.org/foo":           {kind: ipnsRemote, root: "example.org", subpath: "foo"},
+		"ipld://dnslink/git.example.org":  {kind: dnslinkRemote, root: "git.example.org"},
+		"ipfs://dnslink/example.org/repo": {kind: dnslinkRemote, root: "example.org", subpath: "repo"},
+		"ipld+car:///tmp/repo.car":        {kind: carRemote, root: "/tmp/repo.car"},
+	} {
+		u, err := parseURL(raw)
+		if err != nil {
+			t.Errorf("%s: %v", raw, err)
+			continue
+		}
+		if *u != *expected {
+			t.Errorf("%s: expected %+v, got %+v", raw, *expected, *u)
+		}
+	}
+
+	for _, raw := range []string{
+		"http://example.org",
+		"ipld://notacid",
+		"ipld:///foo",
+		"ipfs://" + c + "/../foo",
+		"ipfs://" + c + "/a//b",
+		"ipns://",
+		"ipld://dnslink/",
+		"ipld+car://",
+	} {
+		if _, err := parseURL(raw); err == nil {
+			t.Errorf("%s: expected an error", raw)
+		}
+	}
+}
+
+func TestConfiguredURL(t *testing.T) {
+	tmpdir := setupTest(t)
+	defer os.RemoveAll(tmpdir)
+
+	os.Setenv(STORE_ENV, filepath.Join(tmpdir, "blocks"))
+	defer os.Unsetenv(STORE_ENV)
+
+	_, root := pushCase(t, "ipld://", "push refs/heads/master:refs/heads/master\n")
+
+	repo, err := core.OpenRepo(os.Getenv("GIT_DIR"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = repo.CreateRemote(&config.RemoteConfig{Name: "ipfs", URLs: []string{"/ipfs/" + strings.TrimPrefix(root, IPLD_PREFIX)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCase(t, []string{"git-remote-ipld", "ipfs"}, "list", []string{
+		"@refs/heads/master HEAD",
+		"d5b0d08c180fd7a9bf4f684a37e60ceeb4d25ec8 refs/heads/master",
+	})
+}
+
+func TestSubdirRepo(t *testing.T) {
+	tmpdir := setupTest(t)
+	defer os.RemoveAll(tmpdir)
+
+	os.Setenv(STORE_ENV, filepath.Join(tmpdir, "blocks"))
+	defer os.Unsetenv(STORE_ENV)
+
+	out, one := pushCase(t, "ipfs://"+EMPTY_REPO+"/repos/one", "push refs/heads/master:refs/heads/master\n")
+	if out != "ok refs/heads/master" || !strings.HasSuffix(one, "/repos/one") {
+		t.Fatalf("unexpected output %q, %s", out, one)
+	}
+
+	// a second repository next to the first one
+	outer := strings.TrimSuffix(strings.TrimPrefix(one, IPLD_PREFIX), "/repos/one")
+	_, two := pushCase(t, "/ipfs/"+outer+"/repos/two", "push refs/heads/french:refs/heads/french\n")
+	outer = strings.TrimSuffix(strings.TrimPrefix(two, IPLD_PREFIX), "/repos/two")
+
+	list := func(url string, expected ...string) {
+		t.Helper()
+		testCase(t, []string{"git-remote-ipld", "origin", url}, "list", expected)
+	}
+	list("ipld://"+outer+"/repos/one",
+		"@refs/heads/master HEAD",
+		"d5b0d08c180fd7a9bf4f684a37e60ceeb4d25ec8 refs/heads/master",
+	)
+	list("ipld://"+outer+"/repos/two",
+		"@refs/heads/master HEAD",
+		"162429cc0dac923dff140ec29247f42a8e362419 refs/heads/french",
+	)
+
+	// updating one keeps the other
+	_, one = pushCase(t, "ipld://"+outer+"/repos/one", "push refs/heads/french:refs/heads/french\n")
+	outer = strings.TrimSuffix(strings.TrimPrefix(one, IPLD_PREFIX), "/repos/one")
+	list("ipld://"+outer+"/repos/one",
+		"@refs/heads/master HEAD",
+		"162429cc0dac923dff140ec29247f42a8e362419 refs/heads/french",
+		"d5b0d08c180fd7a9bf4f684a37e60ceeb4d25ec8 refs/heads/master",
+	)
+	list("ipld://"+outer+"/repos/two",
+		"@refs/heads/master HEAD",
+		"162429cc0dac923dff140ec29247f42a8e362419 refs/heads/french",
+	)
+
+	// fetching from a subdirectory brings dropped objects back
+	for _, obj := range []string{"d5/b0d08c180fd7a9bf4f684a37e60ceeb4d25ec8", "58/1caa0fe56cf01dc028cc0b089d364993e046b6", "98/0a0d5f19a64b4b30a87d4206aade58726b60e3"} {
+		if err := os.Remove(filepath.Join(tmpdir, ".git", "objects", obj)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.RemoveAll(filepath.Join(tmpdir, ".git", "ipld")); err != nil {
+		t.Fatal(err)
+	}
+
+	args := []string{"git-remote-ipld", "origin", "ipld://" + outer + "/repos/one"}
+	testCase(t, args, "fetch d5b0d08c180fd7a9bf4f684a37e60ceeb4d25ec8 refs/heads/master\n", []string{""})
+	comparePullToMock(t, tmpdir, "git")
+
+	// an exported archive holds the repository only, not the outer directory
+	carPath := filepath.Join(tmpdir, "one.car")
+	os.Setenv(EXPORT_CAR_ENV, carPath)
+	defer os.Unsetenv(EXPORT_CAR_ENV)
+	pushCase(t, "ipld://"+outer+"/repos/one", "push refs/heads/master:refs/heads/exported\n")
+	list(CAR_PREFIX+carPath,
+		"@refs/heads/master HEAD",
+		"d5b0d08c180fd7a9bf4f684a37e60ceeb4d25ec8 refs/heads/exported",
+		"162429cc0dac923dff140ec29247f42a8e362419 refs/heads/french",
+		"d5b0d08c180fd7a9bf4f684a37e60ceeb4d25ec8 refs/heads/master",
+	)
+}
+
+// TestOfflinePatchCid checks root directories built without a daemon match
+// `ipfs object patch add-link -p` and `rm-link` of go-ipfs
+func TestOfflinePatchCid(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "git-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	store, err := core.NewFileStore(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, err := newOfflineAPI(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hello, err := api.Add(context.Background(), strings.NewReader("hello world\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := api.PatchLink(context.Background(), EMPTY_REPO, "refs/heads/master", hello, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root != "QmZsuytUT2C8cbbBr8RA9qsaHeE7zss5xnz2sziiiBjWUu" {
+		t.Fatalf("unexpected root after add-link %s", root)
+	}
+
+	withHead, err := api.PatchLink(context.Background(), root, "HEAD", hello, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if withHead != "QmVycuD5fBNGt7JrYfJh5CxPcoenm38oZz1CEHs7gRD7MK" {
+		t.Fatalf("unexpected root after second add-link %s", withHead)
+	}
+
+	removed, err := api.Patch(context.Background(), withHead, "rm-link", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != root {
+		t.Fatalf("rm-link gave %s, expected %s", removed, root)
+	}
+}
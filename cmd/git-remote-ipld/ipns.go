@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	core "github.com/ipfs-shipyard/git-remote-ipld/core"
+	ipfs "github.com/ipfs/go-ipfs-api"
+)
+
+const (
+	// IPNS_KEY_ENV and IPNS_LIFETIME_ENV override ipld.<remote>.ipnsKey, the
+	// keystore key ipns:// remotes are published with, and
+	// ipld.<remote>.ipnsLifetime, how long published records stay valid
+	IPNS_KEY_ENV      = "GIT_IPLD_IPNS_KEY"
+	IPNS_LIFETIME_ENV = "GIT_IPLD_IPNS_LIFETIME"
+)
+
+// resolveName points the handler at the root currently published under the
+// ipns name. A name of a local key which was never published starts out as
+// an empty repository.
+func (h *IpnsHandler) resolveName(ctx context.Context, remote *core.Remote) error {
+	key, id, err := h.api.Key(ctx, h.ipnsName)
+	if err != nil {
+		return fmt.Errorf("ipns://%s: %v", h.ipnsName, err)
+	}
+	if id == "" {
+		id = h.ipnsName
+	}
+
+	configured, _, err := remote.RemoteConfigValue(h.gitRemote, "ipnsKey", IPNS_KEY_ENV)
+	if err != nil {
+		return err
+	}
+	if configured != "" {
+		// publishing with another key would go to another name
+		_, keyID, err := h.api.Key(ctx, configured)
+		if err != nil {
+			return fmt.Errorf("ipns://%s: %v", h.ipnsName, err)
+		}
+		if keyID != id {
+			return fmt.Errorf("key %s doesn't publish ipns://%s", configured, h.ipnsName)
+		}
+		key = configured
+	}
+	h.ipnsKey = key
+	h.ipnsID = id
+
+	root, err := h.resolveRoot(ctx, false)
+	if err != nil {
+		if key != "" && isUnresolved(err) {
+			return nil
+		}
+		return fmt.Errorf("resolve ipns://%s: %v", h.ipnsName, err)
+	}
+
+	h.remoteName = root
+	h.currentHash = root
+	return nil
+}
+
+func (h *IpnsHandler) resolveRoot(ctx context.Context, nocache bool) (string, error) {
+	p, err := h.api.Resolve(ctx, h.ipnsID, nocache)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(p, "/ipfs/"), nil
+}
+
+// isUnresolved tells the daemon answered that nothing is published under the
+// name. Any other failure may hide a published root, so it doesn't count.
+func isUnresolved(err error) bool {
+	var e *ipfs.Error
+	return errors.As(err, &e) && strings.Contains(e.Message, "could not resolve name")
+}
+
+// refUpdate is a ref pushed or deleted (next is empty) on top of prev, the
+// ref as resolved from the ipns name before pushing
+type refUpdate struct {
+	ref  string
+	prev string
+	next string
+}
+
+func (h *IpnsHandler) recordUpdate(ctx context.Context, ref, next string) error {
+	if h.ipnsName == "" || h.dryRun {
+		return nil
+	}
+
+	prev, err := h.refCid(ctx, h.remoteName, ref)
+	if err != nil {
+		return err
+	}
+	h.updates = append(h.updates, refUpdate{ref: ref, prev: prev, next: next})
+	return nil
+}
+
+// rebase checks the ipns name still points at the root the push started
+// from, the outer one if the repository is in a subdirectory. If someone else
+// published in the meantime our ref updates are replayed on top of their root,
+// except for refs they touched too, which are returned as failed.
+func (h *IpnsHandler) rebase(ctx context.Context, remote *core.Remote) (map[string]error, error) {
+	// the daemon may cache the name for a minute, long enough to miss a push
+	latest, err := h.resolveRoot(ctx, true)
+	if err != nil {
+		// a name which was published at the start can't be empty now,
+		// replaying onto nothing would drop everyone else's refs
+		if h.outerRoot != EMPTY_REPO || !isUnresolved(err) {
+			return nil, fmt.Errorf("resolve ipns://%s: %v", h.ipnsName, err)
+		}
+		latest = EMPTY_REPO
+	}
+	if latest == h.outerRoot {
+		return nil, nil
+	}
+
+	base, err := h.repoRoot(ctx, latest)
+	if err != nil {
+		return nil, err
+	}
+
+	failed := map[string]error{}
+	root := base
+	for _, u := range h.updates {
+		cur, err := h.refCid(ctx, base, u.ref)
+		if err != nil {
+			return nil, err
+		}
+		if cur != u.prev && cur != u.next {
+			remote.Logger.Printf("%s was updated in ipns://%s during push\n", u.ref, h.ipnsName)
+			failed[u.ref] = core.ErrFetchFirst
+			continue
+		}
+
+		if u.next == "" {
+			cur, err := h.refCid(ctx, root, u.ref)
+			if err != nil {
+				return nil, err
+			}
+			if cur == "" {
+				continue
+			}
+			root, err = h.api.Patch(ctx, root, "rm-link", u.ref)
+		} else {
+			root, err = h.api.PatchLink(ctx, root, u.ref, u.next, true)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rebase: %v", err)
+		}
+	}
+
+	head, err := h.refCid(ctx, root, "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	if head == "" {
+		if head, err = h.refCid(ctx, h.currentHash, "HEAD"); err != nil {
+			return nil, err
+		}
+		if head != "" {
+			if root, err = h.api.PatchLink(ctx, root, "HEAD", head, true); err != nil {
+				return nil, fmt.Errorf("rebase: %v", err)
+			}
+		}
+	}
+
+	// large objects are tracked locally, fill them in again
+	h.outerRoot = latest
+	h.currentHash = root
+	h.largeObjs = nil
+	if err := h.fillMissingLobjs(ctx, remote.Tracker); err != nil {
+		return nil, err
+	}
+
+	remote.Logger.Printf("ipns://%s changed during push, rebased %d ref updates onto %s\n", h.ipnsName, len(h.updates)-len(failed), latest)
+	return failed, nil
+}
+
+// refCid returns the cid a ref links to under root, or an empty string if
+// there is no such ref
+func (h *IpnsHandler) refCid(ctx context.Context, root, ref string) (string, error) {
+	c, err := h.api.ResolvePath(ctx, path.Join(root, ref))
+	if err != nil {
+		if isNoLink(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return c, nil
+}
+
+// checkPublish fails pushes to names we can't publish before anything is
+// pushed
+func (h *IpnsHandler) checkPublish() error {
+	if h.ipnsName != "" && h.ipnsKey == "" {
+		return fmt.Errorf("no local key for ipns://%s, set ipld.%s.ipnsKey", h.ipnsName, h.gitRemote)
+	}
+	return nil
+}
+
+// publish points the ipns name at root
+func (h *IpnsHandler) publish(ctx context.Context, remote *core.Remote, root string) error {
+	var lifetime time.Duration
+	value, name, err := remote.RemoteConfigValue(h.gitRemote, "ipnsLifetime", IPNS_LIFETIME_ENV)
+	if err != nil {
+		return err
+	}
+	if value != "" {
+		lifetime, err = time.ParseDuration(value)
+		if err != nil || lifetime <= 0 {
+			return fmt.Errorf("invalid %s value %q", name, value)
+		}
+	}
+
+	resp, err := h.api.PublishWithDetails(ctx, "/ipfs/"+root, h.ipnsKey, lifetime, 0, false)
+	if err != nil {
+		return fmt.Errorf("publish ipns://%s: %v", h.ipnsName, err)
+	}
+
+	remote.Logger.Printf("Published as \x1b[32mipns://%s\x1b[39m\n", resp.Name)
+	return nil
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"strings"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 
 	"github.com/ipfs-shipyard/git-remote-ipld/core"
 )
@@ -13,30 +16,62 @@ import (
 const (
 	IPLD_PREFIX = "ipld://"
 	IPFS_PREFIX = "ipfs://"
+	IPNS_PREFIX = "ipns://"
+	CAR_PREFIX  = "ipld+car://"
 
 	EMPTY_REPO = "QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn"
+
+	// STORE_ENV points to a directory used as a flat-file block store instead
+	// of the local IPFS daemon
+	STORE_ENV = "GIT_IPLD_STORE"
+
+	// EXPORT_CAR_ENV names a CAR file pushed repository is exported to
+	EXPORT_CAR_ENV = "GIT_IPLD_EXPORT_CAR"
+
+	// PACK_DELTAS_ENV enables delta compression of fetched packs
+	PACK_DELTAS_ENV = "GIT_IPLD_PACK_DELTAS"
 )
 
 func Main(args []string, reader io.Reader, writer io.Writer, logger *log.Logger) error {
-	if len(args) < 3 {
-		return fmt.Errorf("usage: git-remote-ipns remote-name url")
+	if isFsck(args) {
+		return fsck(args[2:], logger)
 	}
 
-	remoteName := args[2]
-	if strings.HasPrefix(remoteName, IPLD_PREFIX) || strings.HasPrefix(remoteName, IPFS_PREFIX) {
-		remoteName = remoteName[len(IPLD_PREFIX):]
+	if len(args) < 2 {
+		return fmt.Errorf("usage: git-remote-ipld remote-name [url]")
 	}
 
-	if remoteName == "" {
-		remoteName = EMPTY_REPO
+	// git leaves the url out when it is the configured one
+	var raw string
+	var err error
+	if len(args) > 2 {
+		raw = args[2]
+	} else if raw, err = remoteConfigURL(args[1]); err != nil {
+		return err
 	}
 
-	remote, err := core.NewRemote(&IpnsHandler{remoteName: remoteName}, reader, writer, logger)
+	u, err := parseURL(raw)
+	if err != nil {
+		return err
+	}
+
+	handler, store, err := newHandler(u, args[1])
+	if err != nil {
+		return err
+	}
+
+	// stop cleanly on ctrl-c, the tracker is left consistent
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	remote, err := core.NewRemote(ctx, handler, store, reader, writer, logger)
 	if err != nil {
 		return err
 	}
 
-	if err := remote.ProcessCommands(); err != nil {
+	remote.PackDeltas, _ = strconv.ParseBool(os.Getenv(PACK_DELTAS_ENV))
+
+	if err := remote.ProcessCommands(ctx); err != nil {
 		err2 := remote.Close()
 		if err2 != nil {
 			return fmt.Errorf("%s; close error: %s", err, err2)
@@ -47,6 +82,104 @@ func Main(args []string, reader io.Reader, writer io.Writer, logger *log.Logger)
 	return remote.Close()
 }
 
+// newHandler opens the store the remote lives in and sets the handler up to
+// find the repository root there, the handler resolves the subpath
+func newHandler(u *remoteURL, gitRemote string) (*IpnsHandler, core.BlockStore, error) {
+	h := &IpnsHandler{gitRemote: gitRemote, subpath: u.subpath, carPath: os.Getenv(EXPORT_CAR_ENV)}
+
+	var store core.BlockStore
+	var err error
+	if u.kind == carRemote {
+		h.api, store, h.remoteName, err = openCar(u.root)
+	} else {
+		h.api, store, err = openStore()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// ipns and dnslink remotes are resolved to the current root by the handler
+	switch u.kind {
+	case ipldRemote:
+		h.remoteName = u.root
+	case ipnsRemote:
+		h.ipnsName = u.root
+	case dnslinkRemote:
+		h.dnslink = u.root
+		h.resolver = dnsResolver
+	}
+
+	if h.remoteName == "" {
+		h.remoteName = EMPTY_REPO
+	}
+	return h, store, nil
+}
+
+// remoteConfigURL returns the url configured for a named remote
+func remoteConfigURL(name string) (string, error) {
+	gitDir, err := findGitDir()
+	if err != nil {
+		return "", err
+	}
+
+	repo, err := core.OpenRepo(gitDir)
+	if err != nil {
+		return "", err
+	}
+
+	remote, err := repo.Remote(name)
+	if err != nil {
+		return "", fmt.Errorf("remote %s: %v", name, err)
+	}
+	if urls := remote.Config().URLs; len(urls) > 0 {
+		return urls[0], nil
+	}
+	return "", fmt.Errorf("remote %s has no url", name)
+}
+
+func openStore() (ipfsAPI, core.BlockStore, error) {
+	if dir := os.Getenv(STORE_ENV); dir != "" {
+		store, err := core.NewFileStore(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		api, err := newOfflineAPI(store)
+		if err != nil {
+			return nil, nil, err
+		}
+		api.names = filepath.Join(dir, "ipns")
+		return api, store, nil
+	}
+
+	api := core.NewLocalShell()
+	if api == nil {
+		return nil, nil, fmt.Errorf("no local IPFS daemon found, start one or set %s", STORE_ENV)
+	}
+	return &shellAPI{sh: api}, core.NewShellStore(api), nil
+}
+
+// openCar opens a CAR archive as a read-only store, the repository root is
+// the first root of the archive
+func openCar(p string) (ipfsAPI, core.BlockStore, string, error) {
+	store, err := core.OpenCarStore(p)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	if len(store.Roots()) == 0 {
+		store.Close()
+		return nil, nil, "", fmt.Errorf("car %s has no roots", p)
+	}
+
+	api, err := newOfflineAPI(store)
+	if err != nil {
+		store.Close()
+		return nil, nil, "", err
+	}
+	return api, store, store.Roots()[0].String(), nil
+}
+
 func main() {
 	if err := Main(os.Args, os.Stdin, os.Stdout, nil); err != nil {
 		fmt.Fprintf(os.Stderr, "\x1b[K")
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	core "github.com/ipfs-shipyard/git-remote-ipld/core"
+	ipfs "github.com/ipfs/go-ipfs-api"
+
+	"github.com/ipfs/go-cid"
+)
+
+// localStore is a BlockStore which can also hold non-git blocks
+type localStore interface {
+	core.BlockStore
+	PutBlock(c cid.Cid, data []byte) error
+}
+
+// offlineAPI implements ipfsAPI on top of a localStore so the handler can
+// maintain the repository root directory without a running daemon
+type offlineAPI struct {
+	store localStore
+
+	emptyDir cid.Cid
+
+	// names is where ipns names are kept, one file per name holding the
+	// published path. Without it names aren't supported.
+	names string
+}
+
+func newOfflineAPI(store localStore) (*offlineAPI, error) {
+	emptyDir, err := core.NewDirNode().Cid()
+	if err != nil {
+		return nil, err
+	}
+
+	return &offlineAPI{
+		store:    store,
+		emptyDir: emptyDir,
+	}, nil
+}
+
+func (a *offlineAPI) Cat(ctx context.Context, p string) (io.ReadCloser, error) {
+	c, err := a.resolve(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := core.ReadUnixfsFile(c, a.getter(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (a *offlineAPI) List(ctx context.Context, p string) ([]*ipfs.LsLink, error) {
+	c, err := a.resolve(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	get := a.getter(ctx)
+	nd, _, err := core.LoadUnixfsNode(c, get)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]*ipfs.LsLink, 0, len(nd.Links))
+	for _, l := range nd.Links {
+		link := &ipfs.LsLink{Hash: l.Hash.String(), Name: l.Name, Size: l.Tsize, Type: -1}
+
+		switch l.Hash.Type() {
+		case cid.DagProtobuf:
+			_, fsData, err := core.LoadUnixfsNode(l.Hash, get)
+			if err != nil {
+				return nil, err
+			}
+			link.Type = ipfs.TFile
+			if fsData.Type == core.UnixfsDirectory {
+				link.Type = ipfs.TDirectory
+			}
+		case cid.Raw:
+			link.Type = ipfs.TFile
+		}
+
+		out = append(out, link)
+	}
+	return out, nil
+}
+
+func (a *offlineAPI) Add(ctx context.Context, r io.Reader) (string, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+
+	c, _, err := core.BuildUnixfsFile(data, a.store.PutBlock)
+	if err != nil {
+		return "", err
+	}
+	return c.String(), nil
+}
+
+// Key accepts any name, there is no keystore to check offline
+func (a *offlineAPI) Key(ctx context.Context, nameOrID string) (string, string, error) {
+	if a.names == "" {
+		return "", "", nil
+	}
+	return nameOrID, nameOrID, nil
+}
+
+func (a *offlineAPI) Resolve(ctx context.Context, name string, nocache bool) (string, error) {
+	p, err := a.namePath(name)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		// answer like the daemon does
+		return "", &ipfs.Error{Command: "name/resolve", Message: "could not resolve name " + name}
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (a *offlineAPI) PublishWithDetails(ctx context.Context, contentHash, key string, lifetime, ttl time.Duration, resolve bool) (*ipfs.PublishResponse, error) {
+	p, err := a.namePath(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(a.names, 0755); err != nil {
+		return nil, err
+	}
+
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(contentHash+"\n"), 0644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		return nil, err
+	}
+	return &ipfs.PublishResponse{Name: key, Value: contentHash}, nil
+}
+
+func (a *offlineAPI) namePath(name string) (string, error) {
+	if a.names == "" {
+		return "", fmt.Errorf("ipns names need a daemon or %s", STORE_ENV)
+	}
+	if name == "" || strings.ContainsAny(name, "/\\") || name[0] == '.' {
+		return "", fmt.Errorf("invalid name %q", name)
+	}
+	return filepath.Join(a.names, name), nil
+}
+
+// Pin is a no-op, local stores never collect garbage
+func (a *offlineAPI) Pin(ctx context.Context, p string) error {
+	return nil
+}
+
+func (a *offlineAPI) Unpin(ctx context.Context, p string) error {
+	return nil
+}
+
+func (a *offlineAPI) PatchLink(ctx context.Context, root, p, childhash string, create bool) (string, error) {
+	rootCid, err := a.resolve(ctx, root)
+	if err != nil {
+		return "", err
+	}
+
+	child, err := cid.Parse(childhash)
+	if err != nil {
+		return "", err
+	}
+
+	size, err := a.size(ctx, child)
+	if err != nil {
+		return "", err
+	}
+
+	c, _, err := a.patch(ctx, rootCid, strings.Split(strings.Trim(p, "/"), "/"), &core.PBLink{Hash: child, Tsize: size}, create)
+	if err != nil {
+		return "", err
+	}
+	return c.String(), nil
+}
+
+// Patch supports the rm-link action only
+func (a *offlineAPI) Patch(ctx context.Context, root, action string, args ...string) (string, error) {
+	if action != "rm-link" || len(args) != 1 {
+		return "", fmt.Errorf("offline patch: unsupported action %s", action)
+	}
+
+	rootCid, err := a.resolve(ctx, root)
+	if err != nil {
+		return "", err
+	}
+
+	c, _, err := a.patch(ctx, rootCid, strings.Split(strings.Trim(args[0], "/"), "/"), nil, false)
+	if err != nil {
+		return "", err
+	}
+	return c.String(), nil
+}
+
+func (a *offlineAPI) ResolvePath(ctx context.Context, p string) (string, error) {
+	c, err := a.resolve(ctx, p)
+	if err != nil {
+		return "", err
+	}
+	return c.String(), nil
+}
+
+func (a *offlineAPI) DagPut(ctx context.Context, data []byte, ienc, kind string) (string, error) {
+	if ienc != "raw" || kind != "git" {
+		return "", fmt.Errorf("offline dag put: unsupported input %s/%s", ienc, kind)
+	}
+	return a.store.Put(ctx, data)
+}
+
+func (a *offlineAPI) getter(ctx context.Context) core.BlockGetter {
+	return func(c cid.Cid) ([]byte, error) {
+		// EMPTY_REPO must resolve even if the store has never seen it
+		if c.Equals(a.emptyDir) {
+			return core.NewDirNode().Marshal(), nil
+		}
+		return a.store.Get(ctx, c.String())
+	}
+}
+
+func (a *offlineAPI) resolve(ctx context.Context, p string) (cid.Cid, error) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(p, "/ipfs/"), "/"), "/")
+
+	c, err := cid.Parse(parts[0])
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	for _, name := range parts[1:] {
+		nd, _, err := core.LoadUnixfsNode(c, a.getter(ctx))
+		if err != nil {
+			return cid.Undef, err
+		}
+
+		l, ok := nd.Link(name)
+		if !ok {
+			return cid.Undef, fmt.Errorf("no link named %q under %s", name, c)
+		}
+		c = l.Hash
+	}
+	return c, nil
+}
+
+// patch sets the link at the given path below c, or removes it if link is
+// nil, creating intermediate directories if asked to. It returns the new
+// node with its cumulative size.
+func (a *offlineAPI) patch(ctx context.Context, c cid.Cid, parts []string, link *core.PBLink, create bool) (cid.Cid, uint64, error) {
+	nd, _, err := core.LoadUnixfsNode(c, a.getter(ctx))
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+
+	if len(parts) == 1 {
+		if link == nil {
+			if !nd.RemoveLink(parts[0]) {
+				return cid.Undef, 0, fmt.Errorf("no link named %q under %s", parts[0], c)
+			}
+		} else {
+			link.Name = parts[0]
+			nd.SetLink(*link)
+		}
+	} else {
+		var sub cid.Cid
+		if l, ok := nd.Link(parts[0]); ok {
+			sub = l.Hash
+		} else {
+			if !create {
+				return cid.Undef, 0, fmt.Errorf("no link named %q under %s", parts[0], c)
+			}
+
+			sub = a.emptyDir
+		}
+
+		newSub, size, err := a.patch(ctx, sub, parts[1:], link, create)
+		if err != nil {
+			return cid.Undef, 0, err
+		}
+		nd.SetLink(core.PBLink{Name: parts[0], Hash: newSub, Tsize: size})
+	}
+
+	newCid, err := nd.Cid()
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+	if err := a.store.PutBlock(newCid, nd.Marshal()); err != nil {
+		return cid.Undef, 0, err
+	}
+	return newCid, nd.Size(), nil
+}
+
+func (a *offlineAPI) size(ctx context.Context, c cid.Cid) (uint64, error) {
+	data, err := a.getter(ctx)(c)
+	if err != nil {
+		return 0, err
+	}
+
+	if c.Type() != cid.DagProtobuf {
+		return uint64(len(data)), nil
+	}
+
+	nd, err := core.UnmarshalPBNode(data)
+	if err != nil {
+		return 0, err
+	}
+	return nd.Size(), nil
+}
+
+// overlayStore keeps written blocks in memory and reads everything else from
+// the underlying store
+type overlayStore struct {
+	lk     sync.Mutex
+	base   core.BlockStore
+	blocks map[string][]byte
+}
+
+func newOverlayStore(base core.BlockStore) *overlayStore {
+	return &overlayStore{
+		base:   base,
+		blocks: map[string][]byte{},
+	}
+}
+
+func (s *overlayStore) Get(ctx context.Context, c string) ([]byte, error) {
+	s.lk.Lock()
+	data, ok := s.blocks[c]
+	s.lk.Unlock()
+	if ok {
+		return data, nil
+	}
+	return s.base.Get(ctx, c)
+}
+
+func (s *overlayStore) Put(ctx context.Context, data []byte) (string, error) {
+	sum := sha1.Sum(data)
+	c, err := core.CidFromHex(hex.EncodeToString(sum[:]))
+	if err != nil {
+		return "", err
+	}
+
+	return c.String(), s.PutBlock(c, data)
+}
+
+func (s *overlayStore) PutBlock(c cid.Cid, data []byte) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	s.blocks[c.String()] = data
+	return nil
+}
+
+func (s *overlayStore) Has(ctx context.Context, c string) (bool, error) {
+	s.lk.Lock()
+	_, ok := s.blocks[c]
+	s.lk.Unlock()
+	if ok {
+		return true, nil
+	}
+	return s.base.Has(ctx, c)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	core "github.com/ipfs-shipyard/git-remote-ipld/core"
+)
+
+const (
+	// PIN_ENV and PIN_KEEP_ENV override ipld.pin, whether pushed roots are
+	// pinned, and ipld.pinKeep, how many of the most recent roots of a remote
+	// stay pinned. With pinKeep 0 roots are never unpinned.
+	PIN_ENV      = "GIT_IPLD_PIN"
+	PIN_KEEP_ENV = "GIT_IPLD_PIN_KEEP"
+
+	// PIN_SERVICE_ENV, PIN_SERVICE_TOKEN_ENV and PIN_SERVICE_WAIT_ENV override
+	// ipld.<remote>.pinService, the endpoint of a remote pinning service,
+	// ipld.<remote>.pinServiceToken, its access token, and
+	// ipld.<remote>.pinServiceWait, how long to wait for it to finish pinning
+	PIN_SERVICE_ENV       = "GIT_IPLD_PIN_SERVICE"
+	PIN_SERVICE_TOKEN_ENV = "GIT_IPLD_PIN_SERVICE_TOKEN"
+	PIN_SERVICE_WAIT_ENV  = "GIT_IPLD_PIN_SERVICE_WAIT"
+
+	PIN_TRACKER_PREFIX         = "//pins"
+	PIN_REQUEST_TRACKER_PREFIX = "//pinrequests"
+
+	defaultPinServiceWait = 2 * time.Minute
+)
+
+// pinRoot pins root recursively, so the daemon doesn't collect a repository
+// we just published, and unpins roots of earlier pushes to the same remote
+// which fall out of the retention window
+func (h *IpnsHandler) pinRoot(ctx context.Context, remote *core.Remote, root string) error {
+	enabled, err := remote.ConfigBool("pin", PIN_ENV, true)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		return nil
+	}
+
+	keep, err := remote.ConfigInt("pinKeep", PIN_KEEP_ENV, 1)
+	if err != nil {
+		return err
+	}
+
+	if err := h.api.Pin(ctx, root); err != nil {
+		return fmt.Errorf("pin %s: %v", root, err)
+	}
+
+	return rotatePins(remote, PIN_TRACKER_PREFIX, h.pinKey(), root, keep, func(old string) error {
+		err := h.api.Unpin(ctx, old)
+		if err != nil && strings.Contains(err.Error(), "not pinned") {
+			return nil
+		}
+		return err
+	})
+}
+
+// pinRemote asks the pinning service configured for the remote to pin root
+// and waits for it to finish. Requests of earlier pushes are removed like
+// local pins.
+func (h *IpnsHandler) pinRemote(ctx context.Context, remote *core.Remote, root string) error {
+	endpoint, _, err := remote.RemoteConfigValue(h.gitRemote, "pinService", PIN_SERVICE_ENV)
+	if err != nil || endpoint == "" {
+		return err
+	}
+	token, _, err := remote.RemoteConfigValue(h.gitRemote, "pinServiceToken", PIN_SERVICE_TOKEN_ENV)
+	if err != nil {
+		return err
+	}
+
+	wait := defaultPinServiceWait
+	value, name, err := remote.RemoteConfigValue(h.gitRemote, "pinServiceWait", PIN_SERVICE_WAIT_ENV)
+	if err != nil {
+		return err
+	}
+	if value != "" {
+		wait, err = time.ParseDuration(value)
+		if err != nil || wait < 0 {
+			return fmt.Errorf("invalid %s value %q", name, value)
+		}
+	}
+
+	keep, err := remote.ConfigInt("pinKeep", PIN_KEEP_ENV, 1)
+	if err != nil {
+		return err
+	}
+
+	service := core.NewPinService(endpoint, token)
+	status, err := service.Add(ctx, core.Pin{Cid: root, Name: "git-remote-ipld " + h.gitRemote})
+	if err != nil {
+		return fmt.Errorf("pin %s: %v", root, err)
+	}
+	remote.Logger.Printf("Requested pin of %s from %s\n", root, endpoint)
+
+	waitCtx, cancel := context.WithTimeout(ctx, wait)
+	status, err = service.Wait(waitCtx, status)
+	cancel()
+
+	switch {
+	case err == context.DeadlineExceeded && ctx.Err() == nil:
+		// keep the request, the service carries on without us. It may still
+		// fail, earlier pins are only rotated out once a later one is pinned.
+		remote.Logger.Printf("Pin of %s still %s, request %s\n", root, status.Status, status.RequestID)
+		keep = 0
+	case err != nil:
+		return fmt.Errorf("pin %s: %v", root, err)
+	case status.Status != core.PinPinned:
+		return fmt.Errorf("pin %s: pinning service reports %s", root, status.Status)
+	default:
+		remote.Logger.Printf("Pinned %s at %s\n", root, endpoint)
+	}
+
+	return rotatePins(remote, PIN_REQUEST_TRACKER_PREFIX, h.pinKey(), status.RequestID, keep, func(old string) error {
+		err := service.Remove(ctx, old)
+		if err != nil && strings.Contains(err.Error(), "NOT_FOUND") {
+			return nil
+		}
+		return err
+	})
+}
+
+// pinKey identifies the remote pins are rotated for. Pushes to an ad-hoc
+// ipld:// url have nothing in common, git names the remote after the url
+// then, so their pins are never rotated.
+func (h *IpnsHandler) pinKey() string {
+	switch {
+	case h.ipnsID != "":
+		return "ipns://" + h.ipnsID
+	case h.dnslink != "":
+		return "dnslink://" + h.dnslink
+	case strings.Contains(h.gitRemote, "://"):
+		return ""
+	}
+	return h.gitRemote
+}
+
+// rotatePins records latest first among pins kept under prefix/key and drops
+// the ones past keep with unpin. Pins failing to unpin are retried next time.
+// Nothing is recorded without a key.
+func rotatePins(remote *core.Remote, prefix, key, latest string, keep int, unpin func(old string) error) error {
+	if key == "" {
+		return nil
+	}
+	key = prefix + "/" + key
+
+	pinned, err := remote.Tracker.Get(key)
+	if err != nil {
+		return err
+	}
+
+	pins := []string{latest}
+	for _, p := range strings.Fields(string(pinned)) {
+		if p != latest {
+			pins = append(pins, p)
+		}
+	}
+
+	if keep > 0 && len(pins) > keep {
+		kept := append([]string(nil), pins[:keep]...)
+		for _, old := range pins[keep:] {
+			if err := unpin(old); err != nil {
+				// the push went through, try again next time
+				remote.Logger.Printf("unpin %s: %v\n", old, err)
+				kept = append(kept, old)
+			}
+		}
+		pins = kept
+	}
+
+	return remote.Tracker.Set(key, []byte(strings.Join(pins, "\n")))
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/ipfs-shipyard/git-remote-ipld/core"
+	ipfs "github.com/ipfs/go-ipfs-api"
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+// shellAPI implements ipfsAPI on top of the daemon http api. Every request
+// is bound to a context, and to timeout unless it may legitimately take long.
+type shellAPI struct {
+	sh *core.Shell
+
+	// timeout bounds single requests, 0 disables it
+	timeout time.Duration
+}
+
+type hashOutput struct {
+	Hash string
+}
+
+func (s *shellAPI) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.timeout)
+}
+
+// request starts a request bound to ctx and the timeout, cancel releases it
+func (s *shellAPI) request(ctx context.Context, command string, args ...string) (*ipfs.RequestBuilder, context.CancelFunc) {
+	ctx, cancel := s.withTimeout(ctx)
+	return s.sh.Request(ctx, command, args...), cancel
+}
+
+// cancelReader releases the request context once the body is closed
+type cancelReader struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (r *cancelReader) Close() error {
+	defer r.cancel()
+	return r.ReadCloser.Close()
+}
+
+func (s *shellAPI) Cat(ctx context.Context, p string) (io.ReadCloser, error) {
+	req, cancel := s.request(ctx, "cat", p)
+	resp, err := req.Send(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.Error != nil {
+		resp.Close()
+		cancel()
+		return nil, resp.Error
+	}
+	return &cancelReader{resp.Output, cancel}, nil
+}
+
+func (s *shellAPI) List(ctx context.Context, p string) ([]*ipfs.LsLink, error) {
+	req, cancel := s.request(ctx, "ls", p)
+	defer cancel()
+
+	var out struct{ Objects []ipfs.LsObject }
+	if err := req.Exec(ctx, &out); err != nil {
+		return nil, err
+	}
+	if len(out.Objects) != 1 {
+		return nil, errors.New("bad response from server")
+	}
+	return out.Objects[0].Links, nil
+}
+
+func (s *shellAPI) Add(ctx context.Context, r io.Reader) (string, error) {
+	req, cancel := s.request(ctx, "add")
+	defer cancel()
+
+	dir := files.NewSliceDirectory([]files.DirEntry{files.FileEntry("", files.NewReaderFile(r))})
+
+	var out hashOutput
+	err := req.Body(files.NewMultiFileReader(dir, true)).Exec(ctx, &out)
+	return out.Hash, err
+}
+
+func (s *shellAPI) PatchLink(ctx context.Context, root, p, childhash string, create bool) (string, error) {
+	req, cancel := s.request(ctx, "object/patch/add-link", root, p, childhash)
+	defer cancel()
+
+	var out hashOutput
+	err := req.Option("create", create).Exec(ctx, &out)
+	return out.Hash, err
+}
+
+func (s *shellAPI) Patch(ctx context.Context, root, action string, args ...string) (string, error) {
+	req, cancel := s.request(ctx, "object/patch/"+action, root)
+	defer cancel()
+
+	var out hashOutput
+	err := req.Arguments(args...).Exec(ctx, &out)
+	return out.Hash, err
+}
+
+func (s *shellAPI) ResolvePath(ctx context.Context, p string) (string, error) {
+	req, cancel := s.request(ctx, "resolve", p)
+	defer cancel()
+
+	var out struct{ Path string }
+	if err := req.Exec(ctx, &out); err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(out.Path, "/ipfs/"), nil
+}
+
+func (s *shellAPI) DagPut(ctx context.Context, data []byte, ienc, kind string) (string, error) {
+	req, cancel := s.request(ctx, "dag/put")
+	defer cancel()
+
+	dir := files.NewSliceDirectory([]files.DirEntry{files.FileEntry("", files.NewBytesFile(data))})
+
+	var out struct {
+		Cid struct {
+			Target string `json:"/"`
+		}
+	}
+	err := req.Option("input-enc", ienc).
+		Option("format", kind).
+		Option("pin", false).
+		Body(files.NewMultiFileReader(dir, true)).
+		Exec(ctx, &out)
+	return out.Cid.Target, err
+}
+
+// Pin isn't bound by the timeout, a recursive pin may have to fetch the
+// whole repository
+func (s *shellAPI) Pin(ctx context.Context, p string) error {
+	return s.sh.Request(ctx, "pin/add", p).Option("recursive", true).Exec(ctx, nil)
+}
+
+func (s *shellAPI) Unpin(ctx context.Context, p string) error {
+	req, cancel := s.request(ctx, "pin/rm", p)
+	defer cancel()
+	return req.Option("recursive", true).Exec(ctx, nil)
+}
+
+func (s *shellAPI) Key(ctx context.Context, nameOrID string) (string, string, error) {
+	req, cancel := s.request(ctx, "key/list")
+	defer cancel()
+
+	var out struct {
+		Keys []struct {
+			Name string
+			Id   string
+		}
+	}
+	if err := req.Exec(ctx, &out); err != nil {
+		return "", "", err
+	}
+
+	for _, k := range out.Keys {
+		if k.Name == nameOrID || k.Id == nameOrID {
+			return k.Name, k.Id, nil
+		}
+	}
+	return "", "", nil
+}
+
+func (s *shellAPI) Resolve(ctx context.Context, name string, nocache bool) (string, error) {
+	req, cancel := s.request(ctx, "name/resolve", name)
+	defer cancel()
+
+	var out struct{ Path string }
+	err := req.Option("nocache", nocache).Exec(ctx, &out)
+	return out.Path, err
+}
+
+func (s *shellAPI) PublishWithDetails(ctx context.Context, contentHash, key string, lifetime, ttl time.Duration, resolve bool) (*ipfs.PublishResponse, error) {
+	req, cancel := s.request(ctx, "name/publish", contentHash)
+	defer cancel()
+
+	req.Option("resolve", resolve)
+	if key != "" {
+		req.Option("key", key)
+	}
+	if lifetime != 0 {
+		req.Option("lifetime", lifetime)
+	}
+	if ttl > 0 {
+		req.Option("ttl", ttl)
+	}
+
+	var out ipfs.PublishResponse
+	if err := req.Exec(ctx, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
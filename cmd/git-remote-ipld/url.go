@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+)
+
+// kinds of remotes, each is opened differently by newHandler
+const (
+	// ipldRemote is a fixed root, or a new repository if there is none
+	ipldRemote = iota
+	// ipnsRemote follows an ipns name
+	ipnsRemote
+	// dnslinkRemote follows the dnslink record of a domain
+	dnslinkRemote
+	// carRemote is read from a CAR archive on disk
+	carRemote
+)
+
+// remoteURL is a parsed remote address
+type remoteURL struct {
+	kind int
+
+	// root is the cid, ipns name, domain or archive path, depending on kind
+	root string
+
+	// subpath is where the repository lives below root, empty for the root
+	// itself
+	subpath string
+}
+
+// parseURL understands these remote addresses:
+//
+//	ipld://[<cid>[/<subpath>]]
+//	ipfs://[<cid>[/<subpath>]]
+//	ipld://dnslink/<domain>[/<subpath>]
+//	ipns://<name>[/<subpath>]
+//	/ipfs/<cid>[/<subpath>]
+//	/ipns/<name>[/<subpath>]
+//	<cid>[/<subpath>]
+//	ipld+car://<file>
+func parseURL(raw string) (*remoteURL, error) {
+	var kind int
+	var rest string
+
+	switch {
+	case strings.HasPrefix(raw, CAR_PREFIX):
+		p := raw[len(CAR_PREFIX):]
+		if p == "" {
+			return nil, fmt.Errorf("invalid remote url %q: missing archive path", raw)
+		}
+		return &remoteURL{kind: carRemote, root: p}, nil
+	case strings.HasPrefix(raw, IPLD_PREFIX):
+		kind, rest = ipldRemote, raw[len(IPLD_PREFIX):]
+	case strings.HasPrefix(raw, IPFS_PREFIX):
+		kind, rest = ipldRemote, raw[len(IPFS_PREFIX):]
+	case strings.HasPrefix(raw, IPNS_PREFIX):
+		kind, rest = ipnsRemote, raw[len(IPNS_PREFIX):]
+	case strings.HasPrefix(raw, "/ipfs/"):
+		kind, rest = ipldRemote, raw[len("/ipfs/"):]
+	case strings.HasPrefix(raw, "/ipns/"):
+		kind, rest = ipnsRemote, raw[len("/ipns/"):]
+	case !strings.Contains(raw, "://"):
+		kind, rest = ipldRemote, raw
+	default:
+		return nil, fmt.Errorf("unsupported remote url %q", raw)
+	}
+
+	if kind == ipldRemote && strings.HasPrefix(rest, DNSLINK_PREFIX) {
+		kind, rest = dnslinkRemote, rest[len(DNSLINK_PREFIX):]
+	}
+
+	u := &remoteURL{kind: kind}
+	parts := strings.SplitN(strings.TrimSuffix(rest, "/"), "/", 2)
+	u.root = parts[0]
+	if len(parts) == 2 {
+		sub := path.Clean("/" + parts[1])
+		if sub != "/"+parts[1] {
+			return nil, fmt.Errorf("invalid remote url %q: unclean path %s", raw, parts[1])
+		}
+		u.subpath = sub[1:]
+	}
+
+	switch kind {
+	case ipldRemote:
+		if u.root == "" {
+			if u.subpath != "" {
+				return nil, fmt.Errorf("invalid remote url %q: path without a root", raw)
+			}
+			break
+		}
+		if _, err := cid.Parse(u.root); err != nil {
+			return nil, fmt.Errorf("invalid remote url %q: %v", raw, err)
+		}
+	case ipnsRemote:
+		if u.root == "" {
+			return nil, fmt.Errorf("invalid remote url %q: missing name", raw)
+		}
+	case dnslinkRemote:
+		if u.root == "" {
+			return nil, fmt.Errorf("invalid remote url %q: missing domain", raw)
+		}
+	}
+	return u, nil
+}
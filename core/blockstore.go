@@ -0,0 +1,87 @@
+package core
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+// BlockStore is the backend git-raw blocks are read from and written to
+type BlockStore interface {
+	// Get returns raw block data for the given cid
+	Get(ctx context.Context, cid string) ([]byte, error)
+
+	// Put stores raw git object and returns its cid
+	Put(ctx context.Context, data []byte) (string, error)
+
+	// Has checks whether the block is present in the store
+	Has(ctx context.Context, cid string) (bool, error)
+}
+
+// ShellStore is a BlockStore backed by go-ipfs http api
+type ShellStore struct {
+	api *Shell
+}
+
+func NewShellStore(api *Shell) *ShellStore {
+	return &ShellStore{
+		api: api,
+	}
+}
+
+func (s *ShellStore) Get(ctx context.Context, cid string) ([]byte, error) {
+	resp, err := s.api.Request(ctx, "block/get", cid).Send(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return ioutil.ReadAll(resp.Output)
+}
+
+func (s *ShellStore) Put(ctx context.Context, data []byte) (string, error) {
+	var out struct {
+		Key string
+	}
+
+	fr := files.NewBytesFile(data)
+	dir := files.NewSliceDirectory([]files.DirEntry{files.FileEntry("", fr)})
+
+	err := s.api.Request(ctx, "block/put").
+		Option("format", "git-raw").
+		Option("mhtype", "sha1").
+		Option("mhlen", -1).
+		Body(files.NewMultiFileReader(dir, true)).
+		Exec(ctx, &out)
+	return out.Key, err
+}
+
+func (s *ShellStore) Has(ctx context.Context, cid string) (bool, error) {
+	var out struct {
+		Key string
+	}
+
+	// block/stat would try to fetch the block from the network, force offline
+	err := s.api.Request(ctx, "block/stat", cid).Option("offline", true).Exec(ctx, &out)
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *ShellStore) String() string {
+	return "ipfs daemon"
+}
+
+func isNotFound(err error) bool {
+	return strings.Contains(err.Error(), "not found")
+}
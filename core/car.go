@@ -0,0 +1,603 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+var carV2Pragma = []byte{0x0a, 0xa1, 0x67, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x02}
+
+const carV2HeaderSize = 40
+
+var ErrReadOnly = errors.New("store is read-only")
+
+var errCarTruncated = errors.New("truncated data")
+
+type carSection struct {
+	offset int64
+	length int
+}
+
+// CarStore is a read-only BlockStore serving blocks straight from a CARv1 or
+// CARv2 archive. Blocks are indexed on open and read in place.
+type CarStore struct {
+	file  *os.File
+	roots []cid.Cid
+	index map[string]carSection
+}
+
+func OpenCarStore(p string) (*CarStore, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &CarStore{
+		file:  f,
+		index: map[string]carSection{},
+	}
+
+	if err := s.loadIndex(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("car %s: %v", p, err)
+	}
+
+	return s, nil
+}
+
+// Roots returns roots declared in the archive header
+func (s *CarStore) Roots() []cid.Cid {
+	return s.roots
+}
+
+func (s *CarStore) Get(ctx context.Context, c string) ([]byte, error) {
+	parsed, err := cid.Parse(c)
+	if err != nil {
+		return nil, err
+	}
+
+	sec, ok := s.index[parsed.KeyString()]
+	if !ok {
+		return nil, fmt.Errorf("block %s not found in car", c)
+	}
+
+	data := make([]byte, sec.length)
+	if _, err := s.file.ReadAt(data, sec.offset); err != nil {
+		return nil, err
+	}
+
+	if err := verifyBlock(parsed, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Put accepts only blocks the archive already contains
+func (s *CarStore) Put(ctx context.Context, data []byte) (string, error) {
+	sum := sha1.Sum(data)
+	c, err := CidFromHex(hex.EncodeToString(sum[:]))
+	if err != nil {
+		return "", err
+	}
+
+	if _, ok := s.index[c.KeyString()]; !ok {
+		return "", ErrReadOnly
+	}
+	return c.String(), nil
+}
+
+func (s *CarStore) PutBlock(c cid.Cid, data []byte) error {
+	if _, ok := s.index[c.KeyString()]; !ok {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+func (s *CarStore) String() string {
+	return "car archive " + s.file.Name()
+}
+
+func (s *CarStore) Has(ctx context.Context, c string) (bool, error) {
+	parsed, err := cid.Parse(c)
+	if err != nil {
+		return false, err
+	}
+
+	_, ok := s.index[parsed.KeyString()]
+	return ok, nil
+}
+
+func (s *CarStore) Close() error {
+	return s.file.Close()
+}
+
+func (s *CarStore) loadIndex() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	// lengths are checked against the file size before allocating, so a
+	// corrupted archive can't make us allocate more than it holds
+	size := info.Size()
+
+	pragma := make([]byte, len(carV2Pragma))
+	if _, err := io.ReadFull(s.file, pragma); err != nil {
+		return err
+	}
+
+	var start, end int64 = 0, -1
+	if bytes.Equal(pragma, carV2Pragma) {
+		hdr := make([]byte, carV2HeaderSize)
+		if _, err := io.ReadFull(s.file, hdr); err != nil {
+			return err
+		}
+
+		// characteristics (16 bytes), data offset, data size, index offset
+		start = int64(binary.LittleEndian.Uint64(hdr[16:24]))
+		dataSize := binary.LittleEndian.Uint64(hdr[24:32])
+		if start < 0 || start > size || dataSize > uint64(size-start) {
+			return errors.New("car payload out of bounds")
+		}
+		end = start + int64(dataSize)
+	}
+
+	if _, err := s.file.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(s.file)
+	pos := start
+
+	hdrLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	pos += int64(uvarintSize(hdrLen))
+	if hdrLen > uint64(size-pos) {
+		return errCarTruncated
+	}
+
+	hdr := make([]byte, hdrLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return err
+	}
+	pos += int64(hdrLen)
+
+	roots, version, err := decodeCarHeader(hdr)
+	if err != nil {
+		return err
+	}
+	if version != 1 {
+		return fmt.Errorf("unsupported car version %d", version)
+	}
+	s.roots = roots
+
+	for end < 0 || pos < end {
+		secLen, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		pos += int64(uvarintSize(secLen))
+
+		// CARv2 payloads may be zero-padded at the end
+		if secLen == 0 {
+			break
+		}
+		if secLen > uint64(size-pos) {
+			return errCarTruncated
+		}
+
+		sec := make([]byte, secLen)
+		if _, err := io.ReadFull(r, sec); err != nil {
+			return err
+		}
+
+		c, n, err := readCid(sec)
+		if err != nil {
+			return err
+		}
+
+		s.index[c.KeyString()] = carSection{offset: pos + int64(n), length: len(sec) - n}
+		pos += int64(secLen)
+	}
+
+	return nil
+}
+
+// CarWriter collects blocks into a temporary file and writes them out as a
+// CARv1 archive once the root is known
+type CarWriter struct {
+	lk    sync.Mutex
+	tmp   *os.File
+	pos   int64
+	index map[string]carSection
+}
+
+func NewCarWriter() (*CarWriter, error) {
+	tmp, err := ioutil.TempFile("", "git-ipld-car")
+	if err != nil {
+		return nil, err
+	}
+
+	return &CarWriter{
+		tmp:   tmp,
+		index: map[string]carSection{},
+	}, nil
+}
+
+// Put appends a block to the archive, duplicates are ignored. Safe to use
+// from multiple goroutines.
+func (w *CarWriter) Put(c cid.Cid, data []byte) error {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+
+	if _, ok := w.index[c.KeyString()]; ok {
+		return nil
+	}
+
+	sec := appendUvarint(nil, uint64(len(c.Bytes())+len(data)))
+	sec = append(sec, c.Bytes()...)
+	offset := w.pos + int64(len(sec))
+	sec = append(sec, data...)
+
+	if _, err := w.tmp.Write(sec); err != nil {
+		return err
+	}
+
+	w.index[c.KeyString()] = carSection{offset: offset, length: len(data)}
+	w.pos += int64(len(sec))
+	return nil
+}
+
+func (w *CarWriter) get(c cid.Cid) ([]byte, bool, error) {
+	w.lk.Lock()
+	sec, ok := w.index[c.KeyString()]
+	w.lk.Unlock()
+	if !ok {
+		return nil, false, nil
+	}
+
+	data := make([]byte, sec.length)
+	if _, err := w.tmp.ReadAt(data, sec.offset); err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// Len returns the number of blocks in the archive
+func (w *CarWriter) Len() int {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	return len(w.index)
+}
+
+// Finish walks the whole dag under root, adding any block which wasn't put
+// yet using get, and writes the archive rooted at root to p
+func (w *CarWriter) Finish(root cid.Cid, get BlockGetter, p string) error {
+	visited := map[string]bool{}
+	stack := []cid.Cid{root}
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if visited[c.KeyString()] {
+			continue
+		}
+		visited[c.KeyString()] = true
+
+		data, ok, err := w.get(c)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			data, err = get(c)
+			if err != nil {
+				return fmt.Errorf("car export %s: %v", c, err)
+			}
+			if err := w.Put(c, data); err != nil {
+				return err
+			}
+		}
+
+		links, err := blockLinks(c, data)
+		if err != nil {
+			return fmt.Errorf("car export %s: %v", c, err)
+		}
+		stack = append(stack, links...)
+	}
+
+	out, err := ioutil.TempFile(path.Dir(p), ".car-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	hdr := encodeCarHeader(root)
+	if _, err := out.Write(append(appendUvarint(nil, uint64(len(hdr))), hdr...)); err != nil {
+		out.Close()
+		return err
+	}
+
+	if _, err := w.tmp.Seek(0, io.SeekStart); err != nil {
+		out.Close()
+		return err
+	}
+	if _, err := io.Copy(out, w.tmp); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(out.Name(), p)
+}
+
+// Close discards the temporary block data
+func (w *CarWriter) Close() error {
+	w.tmp.Close()
+	return os.Remove(w.tmp.Name())
+}
+
+// blockLinks returns cids a dag-pb or git block links to
+func blockLinks(c cid.Cid, data []byte) ([]cid.Cid, error) {
+	var out []cid.Cid
+	switch c.Type() {
+	case cid.DagProtobuf:
+		nd, err := UnmarshalPBNode(data)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range nd.Links {
+			out = append(out, l.Hash)
+		}
+	case cid.GitRaw:
+		// submodule commits belong to other repositories, push leaves them
+		// out too
+		walk, blobs, err := objectLinks(data)
+		if err != nil {
+			return nil, err
+		}
+		for _, hash := range append(walk, blobs...) {
+			c, err := CidFromHex(hash.String())
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+// encodeCarHeader encodes {roots: [root], version: 1} as dag-cbor
+func encodeCarHeader(root cid.Cid) []byte {
+	rootBytes := append([]byte{0}, root.Bytes()...)
+
+	hdr := []byte{0xa2}
+	hdr = appendCborHead(hdr, 3, 5)
+	hdr = append(hdr, "roots"...)
+	hdr = appendCborHead(hdr, 4, 1)
+	hdr = appendCborHead(hdr, 6, 42)
+	hdr = appendCborHead(hdr, 2, uint64(len(rootBytes)))
+	hdr = append(hdr, rootBytes...)
+	hdr = appendCborHead(hdr, 3, 7)
+	hdr = append(hdr, "version"...)
+	return appendCborHead(hdr, 0, 1)
+}
+
+func appendCborHead(out []byte, major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return append(out, major<<5|byte(arg))
+	case arg < 1<<8:
+		return append(out, major<<5|24, byte(arg))
+	case arg < 1<<16:
+		return append(out, major<<5|25, byte(arg>>8), byte(arg))
+	case arg < 1<<32:
+		return append(out, major<<5|26, byte(arg>>24), byte(arg>>16), byte(arg>>8), byte(arg))
+	default:
+		out = append(out, major<<5|27)
+		for i := 7; i >= 0; i-- {
+			out = append(out, byte(arg>>(8*i)))
+		}
+		return out
+	}
+}
+
+// verifyBlock checks that data hashes to c. Git objects go through the same
+// CidFromHex path push uses, other blocks are checked using the cid prefix.
+func verifyBlock(c cid.Cid, data []byte) error {
+	var actual cid.Cid
+	var err error
+	if c.Type() == cid.GitRaw {
+		sum := sha1.Sum(data)
+		actual, err = CidFromHex(hex.EncodeToString(sum[:]))
+	} else {
+		actual, err = c.Prefix().Sum(data)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !actual.Equals(c) {
+		return fmt.Errorf("block %s hashes to %s", c, actual)
+	}
+	return nil
+}
+
+// readCid reads a binary cid from the beginning of data and returns it with
+// its length
+func readCid(data []byte) (cid.Cid, int, error) {
+	n := 0
+	if len(data) >= 2 && data[0] == 0x12 && data[1] == 0x20 {
+		n = 34
+	} else {
+		// version, codec, multihash code and digest length
+		for i := 0; i < 4; i++ {
+			v, l := binary.Uvarint(data[n:])
+			if l <= 0 {
+				return cid.Undef, 0, errors.New("invalid cid")
+			}
+			n += l
+			if i == 3 {
+				n += int(v)
+			}
+		}
+	}
+
+	if n > len(data) {
+		return cid.Undef, 0, errors.New("invalid cid")
+	}
+
+	c, err := cid.Cast(data[:n])
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+	return c, n, nil
+}
+
+func uvarintSize(v uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], v)
+}
+
+// decodeCarHeader decodes {roots: [cids], version: n} dag-cbor header
+func decodeCarHeader(data []byte) ([]cid.Cid, uint64, error) {
+	d := &cborDecoder{data: data}
+	item, err := d.item()
+	if err != nil {
+		return nil, 0, fmt.Errorf("car header: %v", err)
+	}
+
+	m, ok := item.(map[string]interface{})
+	if !ok {
+		return nil, 0, errors.New("car header: not a map")
+	}
+
+	version, _ := m["version"].(uint64)
+
+	var roots []cid.Cid
+	list, _ := m["roots"].([]interface{})
+	for _, r := range list {
+		raw, ok := r.([]byte)
+		if !ok || len(raw) == 0 || raw[0] != 0 {
+			return nil, 0, errors.New("car header: invalid root")
+		}
+
+		c, err := cid.Cast(raw[1:])
+		if err != nil {
+			return nil, 0, fmt.Errorf("car header: %v", err)
+		}
+		roots = append(roots, c)
+	}
+
+	return roots, version, nil
+}
+
+// cborDecoder decodes the small subset of CBOR used in CAR headers. Tags are
+// dropped and their content returned as is.
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *cborDecoder) item() (interface{}, error) {
+	major, arg, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case 0:
+		return arg, nil
+	case 2, 3:
+		if uint64(len(d.data)-d.pos) < arg {
+			return nil, errCarTruncated
+		}
+		b := d.data[d.pos : d.pos+int(arg)]
+		d.pos += int(arg)
+		if major == 3 {
+			return string(b), nil
+		}
+		return b, nil
+	case 4:
+		// every item takes at least a byte
+		if uint64(len(d.data)-d.pos) < arg {
+			return nil, errCarTruncated
+		}
+		out := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			v, err := d.item()
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	case 5:
+		out := map[string]interface{}{}
+		for i := uint64(0); i < arg; i++ {
+			k, err := d.item()
+			if err != nil {
+				return nil, err
+			}
+			v, err := d.item()
+			if err != nil {
+				return nil, err
+			}
+			ks, ok := k.(string)
+			if !ok {
+				return nil, errors.New("non-string map key")
+			}
+			out[ks] = v
+		}
+		return out, nil
+	case 6:
+		return d.item()
+	default:
+		return nil, fmt.Errorf("unsupported cbor major type %d", major)
+	}
+}
+
+func (d *cborDecoder) head() (byte, uint64, error) {
+	if d.pos >= len(d.data) {
+		return 0, 0, errCarTruncated
+	}
+	b := d.data[d.pos]
+	d.pos++
+
+	major, info := b>>5, b&0x1f
+	if info < 24 {
+		return major, uint64(info), nil
+	}
+	if info > 27 {
+		return 0, 0, fmt.Errorf("unsupported cbor argument %d", info)
+	}
+
+	n := 1 << (info - 24)
+	if len(d.data)-d.pos < n {
+		return 0, 0, errCarTruncated
+	}
+
+	var arg uint64
+	for _, c := range d.data[d.pos : d.pos+n] {
+		arg = arg<<8 | uint64(c)
+	}
+	d.pos += n
+	return major, arg, nil
+}
@@ -0,0 +1,205 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	cid "github.com/ipfs/go-cid"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+var testBlob = []byte("blob 6\x00hello\n")
+
+// carV1 builds a CARv1 payload with a single root by hand
+func carV1(root cid.Cid, blocks map[cid.Cid][]byte) []byte {
+	rootBytes := append([]byte{0}, root.Bytes()...)
+
+	// {"roots": [42(root)], "version": 1}
+	hdr := []byte{0xa2, 0x65}
+	hdr = append(hdr, "roots"...)
+	hdr = append(hdr, 0x81, 0xd8, 0x2a, 0x58, byte(len(rootBytes)))
+	hdr = append(hdr, rootBytes...)
+	hdr = append(hdr, 0x67)
+	hdr = append(hdr, "version"...)
+	hdr = append(hdr, 0x01)
+
+	var buf bytes.Buffer
+	buf.Write(appendUvarint(nil, uint64(len(hdr))))
+	buf.Write(hdr)
+	for c, data := range blocks {
+		buf.Write(appendUvarint(nil, uint64(len(c.Bytes())+len(data))))
+		buf.Write(c.Bytes())
+		buf.Write(data)
+	}
+	return buf.Bytes()
+}
+
+func writeTemp(t *testing.T, data []byte) string {
+	dir, err := ioutil.TempDir("", "car-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, "repo.car")
+	if err := ioutil.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestCarStore(t *testing.T) {
+	c, err := CidFromHex("ce013625030ba8dba906f756967f9e9ca394464a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v1 := carV1(c, map[cid.Cid][]byte{c: testBlob})
+
+	// CARv2 wraps the v1 payload behind a pragma and a fixed size header
+	v2 := append([]byte{}, carV2Pragma...)
+	hdr := make([]byte, carV2HeaderSize)
+	binary.LittleEndian.PutUint64(hdr[16:], uint64(len(carV2Pragma)+carV2HeaderSize))
+	binary.LittleEndian.PutUint64(hdr[24:], uint64(len(v1)))
+	v2 = append(append(v2, hdr...), v1...)
+
+	for name, data := range map[string][]byte{"v1": v1, "v2": v2} {
+		p := writeTemp(t, data)
+		defer os.RemoveAll(filepath.Dir(p))
+
+		s, err := OpenCarStore(p)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if len(s.Roots()) != 1 || !s.Roots()[0].Equals(c) {
+			t.Fatalf("%s: unexpected roots %v", name, s.Roots())
+		}
+
+		got, err := s.Get(context.Background(), c.String())
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(got, testBlob) {
+			t.Fatalf("%s: unexpected block %q", name, got)
+		}
+
+		if _, err := s.Put(context.Background(), []byte("blob 0\x00")); err != ErrReadOnly {
+			t.Fatalf("%s: expected read-only error, got %v", name, err)
+		}
+		s.Close()
+	}
+}
+
+func TestCarStoreCorrupted(t *testing.T) {
+	c, err := CidFromHex("ce013625030ba8dba906f756967f9e9ca394464a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := writeTemp(t, carV1(c, map[cid.Cid][]byte{c: []byte("blob 6\x00HELLO\n")}))
+	defer os.RemoveAll(filepath.Dir(p))
+
+	s, err := OpenCarStore(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.Get(context.Background(), c.String()); err == nil {
+		t.Fatal("expected hash mismatch")
+	}
+}
+
+func TestCarWriterSkipsSubmodules(t *testing.T) {
+	blob := plumbing.ComputeHash(plumbing.BlobObject, []byte("hello\n"))
+	foreign := plumbing.NewHash("31f087b9bf39d5bcbba5d4e80b2b4ff19a71dc00")
+
+	var content []byte
+	content = append(append(content, "100644 hello\x00"...), blob[:]...)
+	content = append(append(content, "160000 sub\x00"...), foreign[:]...)
+	tree := append([]byte(fmt.Sprintf("tree %d\x00", len(content))), content...)
+
+	treeCid, err := CidFromHex(plumbing.ComputeHash(plumbing.TreeObject, content).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobCid, err := CidFromHex(blob.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := map[string][]byte{treeCid.KeyString(): tree, blobCid.KeyString(): testBlob}
+	get := func(c cid.Cid) ([]byte, error) {
+		data, ok := blocks[c.KeyString()]
+		if !ok {
+			return nil, fmt.Errorf("%s not found", c)
+		}
+		return data, nil
+	}
+
+	w, err := NewCarWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "car-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the submodule commit lives in another repository, it isn't fetched
+	if err := w.Finish(treeCid, get, filepath.Join(dir, "repo.car")); err != nil {
+		t.Fatal(err)
+	}
+	if w.Len() != 2 {
+		t.Fatalf("expected the tree and the blob, got %d blocks", w.Len())
+	}
+
+	tmp := w.tmp.Name()
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Fatalf("temp archive %s left behind", tmp)
+	}
+}
+
+func TestCarStoreBogusLengths(t *testing.T) {
+	c, err := CidFromHex("ce013625030ba8dba906f756967f9e9ca394464a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := carV1(c, nil)
+
+	// {"roots": [2^62 items...
+	array := []byte{0xa1, 0x65}
+	array = append(array, "roots"...)
+	array = append(array, 0x9b, 0x40, 0, 0, 0, 0, 0, 0, 0)
+
+	v2 := append([]byte{}, carV2Pragma...)
+	hdr := make([]byte, carV2HeaderSize)
+	binary.LittleEndian.PutUint64(hdr[16:24], uint64(len(carV2Pragma)+carV2HeaderSize))
+	binary.LittleEndian.PutUint64(hdr[24:32], 1<<62)
+	v2 = append(append(v2, hdr...), valid...)
+
+	for name, data := range map[string][]byte{
+		"header":  appendUvarint(nil, 1<<62),
+		"section": append(append([]byte{}, valid...), appendUvarint(nil, 1<<62)...),
+		"array":   append(appendUvarint(nil, uint64(len(array))), array...),
+		"v2":      v2,
+	} {
+		p := writeTemp(t, data)
+		defer os.RemoveAll(filepath.Dir(p))
+
+		if s, err := OpenCarStore(p); err == nil {
+			s.Close()
+			t.Errorf("%s: expected bogus length to be rejected", name)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	cid "github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// UnixFS node types as defined in unixfs.proto
+const (
+	UnixfsRaw = iota
+	UnixfsDirectory
+	UnixfsFile
+	UnixfsMetadata
+	UnixfsSymlink
+)
+
+var errTruncated = errors.New("dag-pb: truncated data")
+
+// PBLink is a named link of a dag-pb node
+type PBLink struct {
+	Hash  cid.Cid
+	Name  string
+	Tsize uint64
+}
+
+// PBNode is a minimal dag-pb node, enough to build and walk unixfs trees
+// without going through the daemon
+type PBNode struct {
+	Links []PBLink
+	Data  []byte
+}
+
+// UnixfsData is the unixfs payload stored in PBNode.Data
+type UnixfsData struct {
+	Type       int
+	Data       []byte
+	FileSize   uint64
+	BlockSizes []uint64
+}
+
+// NewDirNode returns an empty unixfs directory
+func NewDirNode() *PBNode {
+	return &PBNode{Data: (&UnixfsData{Type: UnixfsDirectory}).Marshal()}
+}
+
+// Marshal encodes the node, links are written first as dag-pb requires
+func (n *PBNode) Marshal() []byte {
+	var out []byte
+	for _, l := range n.Links {
+		var link []byte
+		link = appendBytesField(link, 1, l.Hash.Bytes())
+		link = appendBytesField(link, 2, []byte(l.Name))
+		link = appendVarintField(link, 3, l.Tsize)
+
+		out = appendBytesField(out, 2, link)
+	}
+	if n.Data != nil {
+		out = appendBytesField(out, 1, n.Data)
+	}
+	return out
+}
+
+// Cid returns CIDv0 of the encoded node
+func (n *PBNode) Cid() (cid.Cid, error) {
+	hash, err := mh.Sum(n.Marshal(), mh.SHA2_256, -1)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return cid.NewCidV0(hash), nil
+}
+
+// Size returns cumulative size of the node and everything it links to
+func (n *PBNode) Size() uint64 {
+	size := uint64(len(n.Marshal()))
+	for _, l := range n.Links {
+		size += l.Tsize
+	}
+	return size
+}
+
+// Link returns the link with the given name
+func (n *PBNode) Link(name string) (*PBLink, bool) {
+	for i := range n.Links {
+		if n.Links[i].Name == name {
+			return &n.Links[i], true
+		}
+	}
+	return nil, false
+}
+
+// SetLink adds or replaces the named link, keeping links sorted by name
+func (n *PBNode) SetLink(link PBLink) {
+	n.RemoveLink(link.Name)
+	n.Links = append(n.Links, link)
+	sort.SliceStable(n.Links, func(i, j int) bool {
+		return n.Links[i].Name < n.Links[j].Name
+	})
+}
+
+// RemoveLink removes the named link, reporting whether it was present
+func (n *PBNode) RemoveLink(name string) bool {
+	for i := range n.Links {
+		if n.Links[i].Name == name {
+			n.Links = append(n.Links[:i], n.Links[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func UnmarshalPBNode(data []byte) (*PBNode, error) {
+	n := &PBNode{}
+	err := readFields(data, func(field int, varint uint64, bytes []byte) error {
+		switch field {
+		case 1:
+			n.Data = bytes
+		case 2:
+			link, err := unmarshalPBLink(bytes)
+			if err != nil {
+				return err
+			}
+			n.Links = append(n.Links, *link)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func unmarshalPBLink(data []byte) (*PBLink, error) {
+	l := &PBLink{}
+	err := readFields(data, func(field int, varint uint64, bytes []byte) error {
+		switch field {
+		case 1:
+			c, err := cid.Cast(bytes)
+			if err != nil {
+				return fmt.Errorf("dag-pb: %v", err)
+			}
+			l.Hash = c
+		case 2:
+			l.Name = string(bytes)
+		case 3:
+			l.Tsize = varint
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (u *UnixfsData) Marshal() []byte {
+	var out []byte
+	out = appendVarintField(out, 1, uint64(u.Type))
+	if u.Data != nil {
+		out = appendBytesField(out, 2, u.Data)
+	}
+	if u.Type == UnixfsFile || u.Type == UnixfsRaw {
+		out = appendVarintField(out, 3, u.FileSize)
+	}
+	for _, bs := range u.BlockSizes {
+		out = appendVarintField(out, 4, bs)
+	}
+	return out
+}
+
+func UnmarshalUnixfs(data []byte) (*UnixfsData, error) {
+	u := &UnixfsData{}
+	err := readFields(data, func(field int, varint uint64, bytes []byte) error {
+		switch field {
+		case 1:
+			u.Type = int(varint)
+		case 2:
+			u.Data = bytes
+		case 3:
+			u.FileSize = varint
+		case 4:
+			u.BlockSizes = append(u.BlockSizes, varint)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func appendVarintField(out []byte, field int, v uint64) []byte {
+	out = appendUvarint(out, uint64(field<<3))
+	return appendUvarint(out, v)
+}
+
+func appendBytesField(out []byte, field int, b []byte) []byte {
+	out = appendUvarint(out, uint64(field<<3|2))
+	out = appendUvarint(out, uint64(len(b)))
+	return append(out, b...)
+}
+
+func appendUvarint(out []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(out, buf[:n]...)
+}
+
+// readFields calls cb for every varint and length-delimited protobuf field
+func readFields(data []byte, cb func(field int, varint uint64, bytes []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errTruncated
+		}
+		data = data[n:]
+
+		var varint uint64
+		var bytes []byte
+		switch key & 7 {
+		case 0:
+			varint, n = binary.Uvarint(data)
+			if n <= 0 {
+				return errTruncated
+			}
+			data = data[n:]
+		case 2:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < l {
+				return errTruncated
+			}
+			bytes = data[n : n+int(l)]
+			data = data[n+int(l):]
+		default:
+			return fmt.Errorf("dag-pb: unexpected wire type %d", key&7)
+		}
+
+		if err := cb(int(key>>3), varint, bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
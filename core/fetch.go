@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -8,18 +9,37 @@ import (
 	"log"
 	"os"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/ipfs/go-cid"
-	ipfs "github.com/ipfs/go-ipfs-api"
+	node "github.com/ipfs/go-ipld-format"
 	"github.com/ipfs/go-ipld-git"
 	mh "github.com/multiformats/go-multihash"
 	"github.com/remeh/sizedwaitgroup"
+	"gopkg.in/src-d/go-git.v4/plumbing"
 )
 
 var ErrNotProvided = errors.New("block not provided")
 
-type ObjectProvider func(cid string, tracker *Tracker) ([]byte, error)
+// checkpointSize is the amount of pack data after which the pack is finished
+// and a new one started, so an interrupted fetch loses at most that much
+const checkpointSize = 64 << 20
+
+type ObjectProvider func(ctx context.Context, cid string, tracker *Tracker) ([]byte, error)
+
+type fetchItem struct {
+	hash string
+
+	// depth of the commit the object was reached from, the base is 1
+	depth int
+
+	// child is set for commits reached as a parent of another commit
+	child string
+}
 
 type Fetch struct {
 	objectDir string
@@ -28,21 +48,55 @@ type Fetch struct {
 	done  uint64
 	todoc uint64
 
-	todo    chan string
+	todo    chan fetchItem
 	log     *log.Logger
 	tracker *Tracker
 
 	errCh  chan error
 	wg     sizedwaitgroup.SizedWaitGroup
 	doneCh chan []byte
-
-	fsLk *sync.Mutex
+	skipCh chan []byte
+
+	// running counts workers, including ones still waiting for a slot
+	running sync.WaitGroup
+
+	// fetched objects are pending in the tracker until the whole fetch
+	// succeeds, seen holds all objects processed by this fetch. Skipped ones
+	// were cut off by Since and never written.
+	fetched [][]byte
+	seen    map[string]bool
+	skipped map[string]bool
+
+	// Depth and Since limit fetched history. Note that commits reachable
+	// through several paths are cut at the depth they were first reached at.
+	Depth int
+	Since time.Time
+
+	// shallow commits had their parents cut off by this fetch, deepened ones
+	// had all their parents fetched. Commits of a fetch which cut history
+	// stay pending, so a later fetch with other limits walks them again.
+	shallowLk sync.Mutex
+	shallow   map[string]bool
+	deepened  map[string]bool
+	commits   map[string]bool
+
+	// Deltas enables delta compression of the fetched pack
+	Deltas bool
+
+	packLk         sync.Mutex
+	pack           *PackWriter
+	checkpointSize int64
+
+	// local reads objects left pending by an interrupted fetch
+	localLk sync.Mutex
+	local   *packReader
 
 	provider ObjectProvider
-	api      *ipfs.Shell
+	store    BlockStore
+	limiter  *Limiter
 }
 
-func NewFetch(gitDir string, tracker *Tracker, provider ObjectProvider) *Fetch {
+func NewFetch(gitDir string, tracker *Tracker, store BlockStore, provider ObjectProvider, limiter *Limiter) *Fetch {
 	return &Fetch{
 		objectDir: path.Join(gitDir, "objects"),
 		gitDir:    gitDir,
@@ -50,39 +104,163 @@ func NewFetch(gitDir string, tracker *Tracker, provider ObjectProvider) *Fetch {
 		log:     log.New(os.Stderr, "fetch: ", 0),
 		tracker: tracker,
 
-		fsLk: &sync.Mutex{},
-
-		wg: sizedwaitgroup.New(512),
+		wg: sizedwaitgroup.New(limiter.Max()),
 
-		//Note: logic below somewhat relies on these channels staying unbuffered
-		todo:   make(chan string),
-		errCh:  make(chan error),
+		//Note: logic below somewhat relies on these channels staying unbuffered,
+		// errCh only keeps the first error
+		todo:   make(chan fetchItem),
+		errCh:  make(chan error, 1),
 		doneCh: make(chan []byte),
+		skipCh: make(chan []byte),
+
+		shallow:  map[string]bool{},
+		deepened: map[string]bool{},
+		commits:  map[string]bool{},
+		seen:     map[string]bool{},
+		skipped:  map[string]bool{},
+
+		checkpointSize: checkpointSize,
 
 		provider: provider,
-		api:      ipfs.NewLocalShell(),
+		store:    store,
+		limiter:  limiter,
 	}
 }
 
-func (f *Fetch) FetchHash(base string) error {
+func (f *Fetch) FetchHash(ctx context.Context, base string) error {
+	local, err := newPackReader(f.objectDir)
+	if err != nil {
+		return fmt.Errorf("fetch: %v", err)
+	}
+	defer local.Close()
+	f.local = local
+
+	if err := f.openPack(); err != nil {
+		return fmt.Errorf("fetch: %v", err)
+	}
+	defer func() {
+		f.pack.Close()
+	}()
+
+	// stop workers on the way out, they may still be running after an error
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	f.running.Add(1)
 	go func() {
-		f.todo <- base
+		defer f.running.Done()
+		f.enqueue(ctx, fetchItem{hash: base, depth: 1})
 	}()
-	return f.doWork()
+	err = f.doWork(ctx)
+	cancel()
+	f.running.Wait()
+
+	// objects written so far are kept, a restarted fetch picks them up
+	if cerr := f.finishPack(); cerr != nil {
+		if err != nil {
+			f.log.Printf("checkpoint: %v\n", cerr)
+			return err
+		}
+		return fmt.Errorf("fetch: %v", cerr)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := f.writeShallow(); err != nil {
+		return err
+	}
+	return f.confirm()
 }
 
-func (f *Fetch) doWork() error {
+// openPack starts a new pack, callers hold packLk once workers are running
+func (f *Fetch) openPack() error {
+	pack, err := NewPackWriter(f.objectDir)
+	if err != nil {
+		return err
+	}
+	pack.Deltas = f.Deltas
+
+	f.pack = pack
+	return nil
+}
+
+// finishPack makes the current pack visible to git, and then pending marks
+// of objects in it durable. Workers must not write to the pack meanwhile.
+func (f *Fetch) finishPack() error {
+	if err := f.pack.Finish(); err != nil {
+		return err
+	}
+	return f.tracker.Flush()
+}
+
+// checkpoint finishes the current pack once it grows big enough and starts
+// a new one
+func (f *Fetch) checkpoint() error {
+	f.packLk.Lock()
+	defer f.packLk.Unlock()
+
+	if f.pack.Size() < f.checkpointSize {
+		return nil
+	}
+	if err := f.finishPack(); err != nil {
+		return err
+	}
+	return f.openPack()
+}
+
+func (f *Fetch) writeObject(hash string, object []byte) error {
+	f.packLk.Lock()
+	defer f.packLk.Unlock()
+
+	return f.pack.Add(hash, object)
+}
+
+// confirm marks all fetched objects as present once nothing is missing
+// below them. Commits stay pending if history was cut anywhere.
+func (f *Fetch) confirm() error {
+	cut := len(f.shallow) > 0
+	for _, sha := range f.fetched {
+		hash := hex.EncodeToString(sha)
+		if f.skipped[hash] || cut && f.commits[hash] {
+			continue
+		}
+		if err := f.tracker.ConfirmPending(sha); err != nil {
+			return fmt.Errorf("fetch: %v", err)
+		}
+	}
+	f.fetched = nil
+
+	if err := f.tracker.Flush(); err != nil {
+		return fmt.Errorf("fetch: %v", err)
+	}
+	return nil
+}
+
+func (f *Fetch) doWork(ctx context.Context) error {
 	for {
 		select {
+		case <-ctx.Done():
+			return ctx.Err()
 		case err := <-f.errCh:
 			return err
-		case hash := <-f.todo:
+		case item := <-f.todo:
 			f.todoc++
-			if err := f.processSingle(hash); err != nil {
+			if err := f.processSingle(ctx, item); err != nil {
 				return err
 			}
 		case <-f.doneCh:
 			f.done++
+			if err := f.checkpoint(); err != nil {
+				return fmt.Errorf("fetch: %v", err)
+			}
+		case sha := <-f.skipCh:
+			// object is outside of requested history, it was never written
+			if err := f.tracker.RemovePending(sha); err != nil {
+				return fmt.Errorf("fetch: %v", err)
+			}
+			f.skipped[hex.EncodeToString(sha)] = true
+			f.done++
 		}
 
 		f.log.Printf("%d/%d\r\x1b[A", f.done, f.todoc)
@@ -95,13 +273,15 @@ func (f *Fetch) doWork() error {
 	}
 }
 
-func (f *Fetch) processSingle(hash string) error {
+func (f *Fetch) processSingle(ctx context.Context, item fetchItem) error {
+	hash := item.hash
 	mhash, err := mh.FromHexString("1114" + hash)
 	if err != nil {
 		return fmt.Errorf("fetch: %v", err)
 	}
 
-	c := cid.NewCidV1(cid.GitRaw, mhash).String()
+	blockCid := cid.NewCidV1(cid.GitRaw, mhash)
+	c := blockCid.String()
 
 	sha, err := hex.DecodeString(hash)
 	if err != nil {
@@ -112,85 +292,251 @@ func (f *Fetch) processSingle(hash string) error {
 	if err != nil {
 		return err
 	}
-	if has {
+	if has || f.seen[hash] {
 		f.todoc--
 		return nil
 	}
+	f.seen[hash] = true
 
-	// Need to do this early
-	if err := f.tracker.AddEntry(sha); err != nil {
+	// left over by an interrupted fetch, the object may be on disk already
+	resumed, err := f.tracker.HasPending(sha)
+	if err != nil {
 		return fmt.Errorf("fetch: %v", err)
 	}
 
+	// Need to do this early, before the object may end up in a pack
+	if !resumed {
+		if err := f.tracker.AddPending(sha); err != nil {
+			return fmt.Errorf("fetch: %v", err)
+		}
+	}
+	f.fetched = append(f.fetched, sha)
+
+	f.running.Add(1)
 	go func() {
-		f.wg.Add()
-		defer f.wg.Done()
+		defer f.running.Done()
 
-		f.fsLk.Lock()
-		objectPath, err := prepHashPath(f.objectDir, hash)
-		f.fsLk.Unlock()
-		if err != nil {
-			f.errCh <- err
+		if err := f.wg.AddWithContext(ctx); err != nil {
 			return
 		}
+		defer f.wg.Done()
 
-		object, err := f.provider(c, f.tracker)
+		var object []byte
+		var err error
+		if resumed {
+			object = f.readLocal(blockCid, hash)
+		}
+		written := object != nil
+
+		source := "remote helper"
+		if object == nil {
+			object, err = f.provider(ctx, c, f.tracker)
+		}
 		if err != nil {
 			if err != ErrNotProvided {
-				f.errCh <- err
+				f.fail(err)
 				return
 			}
 
-			object, err = f.api.BlockGet(c)
+			source = storeName(f.store)
+			err = f.limiter.Do(ctx, func(ctx context.Context) error {
+				object, err = f.store.Get(ctx, c)
+				return err
+			})
 			if err != nil {
-				f.errCh <- fmt.Errorf("fetch: %v", err)
+				f.fail(fmt.Errorf("fetch: %v", err))
 				return
 			}
 		}
 
-		f.processLinks(object)
+		// never let a misbehaving node put bad objects into the repository
+		if !written {
+			if err := verifyBlock(blockCid, object); err != nil {
+				f.fail(fmt.Errorf("fetch: bad block from %s: %v", source, err))
+				return
+			}
+		}
 
-		object = compressObject(object)
+		nd, err := ipldgit.ParseObjectFromBuffer(object)
+		if err != nil {
+			f.fail(fmt.Errorf("fetch: %v", err))
+			return
+		}
 
-		/////////////////
+		if commit, ok := nd.(*ipldgit.Commit); ok && item.child != "" && f.tooOld(commit) {
+			f.markShallow(item.child)
+			select {
+			case f.skipCh <- sha:
+			case <-ctx.Done():
+			}
+			return
+		}
 
-		err = ioutil.WriteFile(*objectPath, object, 0444)
-		if err != nil {
-			f.errCh <- fmt.Errorf("fetch: %v", err)
+		if !f.processLinks(ctx, nd, item) {
 			return
 		}
 
+		if !written {
+			if err := f.writeObject(hash, object); err != nil {
+				f.fail(fmt.Errorf("fetch: %v", err))
+				return
+			}
+		}
+
 		//TODO: see if moving this higher would help
-		f.doneCh <- sha
+		select {
+		case f.doneCh <- sha:
+		case <-ctx.Done():
+		}
 	}()
 
 	return nil
 }
 
-func (f *Fetch) processLinks(object []byte) error {
-	nd, err := ipldgit.ParseObjectFromBuffer(object)
+// readLocal returns an object written by an earlier fetch, or nil if it
+// didn't make it into a pack intact
+func (f *Fetch) readLocal(c cid.Cid, hash string) []byte {
+	f.localLk.Lock()
+	defer f.localLk.Unlock()
+
+	raw, found, err := f.local.Read(plumbing.NewHash(hash))
+	if err == nil && found {
+		err = verifyBlock(c, raw)
+	}
 	if err != nil {
-		return fmt.Errorf("fetch: %v", err)
+		f.log.Printf("%s: %v\n", hash, err)
+		return nil
 	}
+	return raw
+}
 
-	links := nd.Links()
-	for _, link := range links {
-		mhash := link.Cid.Hash()
-		hash := mhash.HexString()[4:]
+// storeName describes the block store in errors
+func storeName(store BlockStore) string {
+	if s, ok := store.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return "block store"
+}
 
-		f.todo <- hash
+// processLinks queues objects linked from nd, it returns false if ctx was
+// cancelled meanwhile
+func (f *Fetch) processLinks(ctx context.Context, nd node.Node, item fetchItem) bool {
+	commit, ok := nd.(*ipldgit.Commit)
+	if !ok {
+		for _, link := range nd.Links() {
+			if !f.enqueue(ctx, fetchItem{hash: hexFromLink(link.Cid), depth: item.depth}) {
+				return false
+			}
+		}
+		return true
 	}
-	return nil
+
+	f.shallowLk.Lock()
+	f.commits[item.hash] = true
+	f.shallowLk.Unlock()
+
+	if !f.enqueue(ctx, fetchItem{hash: hexFromLink(commit.GitTree), depth: item.depth}) {
+		return false
+	}
+
+	if len(commit.Parents) > 0 && f.Depth > 0 && item.depth >= f.Depth {
+		f.markShallow(item.hash)
+		return true
+	}
+
+	f.shallowLk.Lock()
+	f.deepened[item.hash] = true
+	f.shallowLk.Unlock()
+
+	for _, parent := range commit.Parents {
+		if !f.enqueue(ctx, fetchItem{hash: hexFromLink(parent), depth: item.depth + 1, child: item.hash}) {
+			return false
+		}
+	}
+	return true
 }
 
-func prepHashPath(localDir string, hash string) (*string, error) {
-	base := path.Join(localDir, hash[:2])
-	err := os.MkdirAll(base, 0777)
+func (f *Fetch) enqueue(ctx context.Context, item fetchItem) bool {
+	select {
+	case f.todo <- item:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
 
+// fail reports the first error of a worker, later ones are dropped so
+// workers never block
+func (f *Fetch) fail(err error) {
+	select {
+	case f.errCh <- err:
+	default:
+	}
+}
+
+// tooOld checks whether the commit is older than f.Since
+func (f *Fetch) tooOld(commit *ipldgit.Commit) bool {
+	if f.Since.IsZero() || commit.Committer == nil {
+		return false
+	}
+
+	ts, err := strconv.ParseInt(commit.Committer.Date, 10, 64)
 	if err != nil {
-		return nil, err
+		return false
+	}
+	return time.Unix(ts, 0).Before(f.Since)
+}
+
+func (f *Fetch) markShallow(hash string) {
+	f.shallowLk.Lock()
+	f.shallow[hash] = true
+	f.shallowLk.Unlock()
+}
+
+// writeShallow updates .git/shallow, so git treats commits with cut off
+// parents as roots of history. Commits whose parents were fetched now are
+// dropped from it, the file is removed once history is complete.
+func (f *Fetch) writeShallow() error {
+	shallowPath := path.Join(f.gitDir, "shallow")
+	existing, err := ioutil.ReadFile(shallowPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("fetch: %v", err)
+	}
+	if len(existing) == 0 && len(f.shallow) == 0 {
+		return nil
 	}
 
-	objectPath := path.Join(base, hash[2:])
-	return &objectPath, nil
+	final := map[string]bool{}
+	for _, line := range strings.Split(string(existing), "\n") {
+		if line != "" && !f.deepened[line] {
+			final[line] = true
+		}
+	}
+	for hash := range f.shallow {
+		final[hash] = true
+	}
+
+	if len(final) == 0 {
+		if err := os.Remove(shallowPath); err != nil {
+			return fmt.Errorf("fetch: %v", err)
+		}
+		return nil
+	}
+
+	hashes := make([]string, 0, len(final))
+	for hash := range final {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+
+	tmpPath := shallowPath + ".lock"
+	if err := ioutil.WriteFile(tmpPath, []byte(strings.Join(hashes, "\n")+"\n"), 0644); err != nil {
+		return fmt.Errorf("fetch: %v", err)
+	}
+	return os.Rename(tmpPath, shallowPath)
+}
+
+func hexFromLink(c cid.Cid) string {
+	mhash := c.Hash()
+	return mhash.HexString()[4:]
 }
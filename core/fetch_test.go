@@ -0,0 +1,315 @@
+package core
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// hungStore blocks every request until its context is done, like a daemon
+// which stopped responding
+type hungStore struct{}
+
+func (hungStore) Get(ctx context.Context, c string) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (hungStore) Put(ctx context.Context, data []byte) (string, error) {
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+func (hungStore) Has(ctx context.Context, c string) (bool, error) {
+	<-ctx.Done()
+	return false, ctx.Err()
+}
+
+func notProvided(ctx context.Context, c string, tracker *Tracker) ([]byte, error) {
+	return nil, ErrNotProvided
+}
+
+func TestFetchCancel(t *testing.T) {
+	tmpdir, _ := packMock(t)
+	defer os.RemoveAll(tmpdir)
+
+	gitDir := filepath.Join(tmpdir, ".git")
+	tracker, err := NewTracker(gitDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	const hash = "162429cc0dac923dff140ec29247f42a8e362419"
+	fetch := NewFetch(gitDir, tracker, hungStore{}, notProvided, NewLimiter(4))
+	if err := fetch.FetchHash(ctx, hash); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+
+	// nothing was fetched, so nothing may be tracked
+	sha, _ := hex.DecodeString(hash)
+	if has, err := tracker.HasEntry(sha); err != nil || has {
+		t.Fatalf("tracker kept entry of an object which wasn't fetched: %v", err)
+	}
+}
+
+func TestPushCancel(t *testing.T) {
+	tmpdir, _ := packMock(t)
+	defer os.RemoveAll(tmpdir)
+
+	gitDir := filepath.Join(tmpdir, ".git")
+	repo, err := git.PlainOpen(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracker, err := NewTracker(gitDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	const hash = "162429cc0dac923dff140ec29247f42a8e362419"
+	push := NewPush(gitDir, tracker, repo, hungStore{}, NewLimiter(4))
+	if err := push.PushHash(ctx, hash); err == nil {
+		t.Fatal("expected push to fail")
+	}
+
+	sha, _ := hex.DecodeString(hash)
+	if has, err := tracker.HasEntry(sha); err != nil || has {
+		t.Fatalf("tracker marked an object which wasn't stored: %v", err)
+	}
+}
+
+// countingStore counts requests and cancels on the given read or write,
+// like an interrupted git process
+type countingStore struct {
+	BlockStore
+
+	gets, puts                 int32
+	interruptGet, interruptPut int32
+	cancel                     func()
+}
+
+func (s *countingStore) Get(ctx context.Context, c string) ([]byte, error) {
+	if atomic.AddInt32(&s.gets, 1) == s.interruptGet {
+		s.cancel()
+		return nil, context.Canceled
+	}
+	return s.BlockStore.Get(ctx, c)
+}
+
+func (s *countingStore) Put(ctx context.Context, data []byte) (string, error) {
+	if atomic.AddInt32(&s.puts, 1) == s.interruptPut {
+		s.cancel()
+		return "", context.Canceled
+	}
+	return s.BlockStore.Put(ctx, data)
+}
+
+// reachable returns objects linked from hash, including itself
+func reachable(t *testing.T, objects map[string][]byte, hash string) map[plumbing.Hash]bool {
+	out := map[plumbing.Hash]bool{}
+	todo := []plumbing.Hash{plumbing.NewHash(hash)}
+	for len(todo) > 0 {
+		h := todo[0]
+		todo = todo[1:]
+		if out[h] {
+			continue
+		}
+		out[h] = true
+
+		walk, blobs, err := objectLinks(objects[h.String()])
+		if err != nil {
+			t.Fatal(err)
+		}
+		todo = append(append(todo, walk...), blobs...)
+	}
+	return out
+}
+
+// packedObjects counts objects in all packs of objectDir
+func packedObjects(t *testing.T, objectDir string) int64 {
+	r, err := newPackReader(objectDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	var n int64
+	for _, p := range r.packs {
+		c, err := p.idx.Count()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n += c
+	}
+	return n
+}
+
+func TestFetchResume(t *testing.T) {
+	tmpdir, objects := packMock(t)
+	defer os.RemoveAll(tmpdir)
+
+	blocks, err := NewFileStore(filepath.Join(tmpdir, "blocks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, raw := range objects {
+		if _, err := blocks.Put(context.Background(), raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const hash = "162429cc0dac923dff140ec29247f42a8e362419"
+	linked := reachable(t, objects, hash)
+
+	dest, err := ioutil.TempDir("", "fetch-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	gitDir := filepath.Join(dest, ".git")
+	objectDir := filepath.Join(gitDir, "objects")
+
+	tracker, err := NewTracker(gitDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// interrupted once the base and its links are requested
+	store := &countingStore{BlockStore: blocks, interruptGet: 3, cancel: cancel}
+	if err := NewFetch(gitDir, tracker, store, notProvided, NewLimiter(1)).FetchHash(ctx, hash); err == nil {
+		t.Fatal("expected interrupted fetch to fail")
+	}
+
+	sha, _ := hex.DecodeString(hash)
+	if has, err := tracker.HasEntry(sha); err != nil || has {
+		t.Fatalf("incomplete fetch confirmed base: %v", err)
+	}
+	if err := tracker.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	written := packedObjects(t, objectDir)
+	if written == 0 {
+		t.Fatal("interrupted fetch kept nothing")
+	}
+
+	tracker, err = NewTracker(gitDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.Close()
+
+	store = &countingStore{BlockStore: blocks}
+	if err := NewFetch(gitDir, tracker, store, notProvided, NewLimiter(4)).FetchHash(context.Background(), hash); err != nil {
+		t.Fatal(err)
+	}
+
+	if int64(store.gets) != int64(len(linked))-written {
+		t.Fatalf("resumed fetch read %d objects, expected %d", store.gets, int64(len(linked))-written)
+	}
+	if n := packedObjects(t, objectDir); n != int64(len(linked)) {
+		t.Fatalf("expected %d objects on disk, got %d", len(linked), n)
+	}
+
+	for h := range linked {
+		if has, err := tracker.HasEntry(h[:]); err != nil || !has {
+			t.Fatalf("%s not confirmed: %v", h, err)
+		}
+		if pending, err := tracker.HasPending(h[:]); err != nil || pending {
+			t.Fatalf("%s still pending: %v", h, err)
+		}
+	}
+}
+
+// tamperStore flips a byte of one block
+type tamperStore struct {
+	BlockStore
+	bad string
+}
+
+func (s *tamperStore) Get(ctx context.Context, c string) ([]byte, error) {
+	data, err := s.BlockStore.Get(ctx, c)
+	if err != nil || c != s.bad {
+		return data, err
+	}
+
+	data = append([]byte(nil), data...)
+	data[len(data)-1] ^= 0xff
+	return data, nil
+}
+
+func TestFetchBadBlock(t *testing.T) {
+	tmpdir, objects := packMock(t)
+	defer os.RemoveAll(tmpdir)
+
+	blocks, err := NewFileStore(filepath.Join(tmpdir, "blocks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, raw := range objects {
+		if _, err := blocks.Put(context.Background(), raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dest, err := ioutil.TempDir("", "fetch-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	gitDir := filepath.Join(dest, ".git")
+
+	tracker, err := NewTracker(gitDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.Close()
+
+	const hash = "162429cc0dac923dff140ec29247f42a8e362419"
+	var blob string
+	for h := range reachable(t, objects, hash) {
+		if typ, _, _ := splitObject(objects[h.String()]); typ == plumbing.BlobObject {
+			blob = h.String()
+		}
+	}
+	bad := mustCid(t, blob)
+
+	store := &tamperStore{BlockStore: blocks, bad: bad}
+	err = NewFetch(gitDir, tracker, store, notProvided, NewLimiter(4)).FetchHash(context.Background(), hash)
+	if err == nil {
+		t.Fatal("expected fetch of a bad block to fail")
+	}
+	if !strings.Contains(err.Error(), bad) || !strings.Contains(err.Error(), storeName(store)) {
+		t.Fatalf("error doesn't name block and source: %v", err)
+	}
+
+	r, err := newPackReader(filepath.Join(gitDir, "objects"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, found, _ := r.Read(plumbing.NewHash(blob)); found {
+		t.Fatal("bad block was written")
+	}
+}
@@ -0,0 +1,117 @@
+package core
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// FileStore is a BlockStore keeping every block as a file in a local
+// directory, sharded by the next-to-last two characters of the CID like
+// go-ds-flatfs does. It doesn't need a running daemon.
+type FileStore struct {
+	dir string
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &FileStore{
+		dir: dir,
+	}, nil
+}
+
+func (s *FileStore) String() string {
+	return "block directory " + s.dir
+}
+
+func (s *FileStore) Get(ctx context.Context, c string) ([]byte, error) {
+	p, err := s.blockPath(c)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("block %s not found", c)
+	}
+	return data, err
+}
+
+func (s *FileStore) Put(ctx context.Context, data []byte) (string, error) {
+	sum := sha1.Sum(data)
+	c, err := CidFromHex(hex.EncodeToString(sum[:]))
+	if err != nil {
+		return "", err
+	}
+
+	return c.String(), s.PutBlock(c, data)
+}
+
+func (s *FileStore) Has(ctx context.Context, c string) (bool, error) {
+	p, err := s.blockPath(c)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = os.Stat(p)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// PutBlock stores a block of any codec under the given cid. Callers are
+// responsible for the cid matching the data.
+func (s *FileStore) PutBlock(c cid.Cid, data []byte) error {
+	p, err := s.blockPath(c.String())
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(p); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	// write to a temp file first so a crash never leaves a partial block behind
+	tmp, err := ioutil.TempFile(path.Dir(p), ".put-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), p)
+}
+
+func (s *FileStore) blockPath(c string) (string, error) {
+	parsed, err := cid.Parse(c)
+	if err != nil {
+		return "", err
+	}
+
+	key := parsed.String()
+	return path.Join(s.dir, key[len(key)-3:len(key)-1], key), nil
+}
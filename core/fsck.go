@@ -0,0 +1,201 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/remeh/sizedwaitgroup"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// StaleEntry is a tracker entry of an object missing from the block store,
+// the local repository or both
+type StaleEntry struct {
+	Hash plumbing.Hash
+
+	Local  bool
+	Remote bool
+}
+
+// Missing tells where the object is missing from
+func (e StaleEntry) Missing() string {
+	switch {
+	case !e.Local && !e.Remote:
+		return "block store and local objects"
+	case !e.Remote:
+		return "block store"
+	default:
+		return "local objects"
+	}
+}
+
+type FsckReport struct {
+	Checked int
+	Stale   []StaleEntry
+
+	// Removed counts entries removed by repair, including entries of objects
+	// linking to stale ones
+	Removed int
+}
+
+// Fsck checks that objects recorded in the tracker are still present in the
+// block store and the local repository, either may have been pruned since
+type Fsck struct {
+	log     *log.Logger
+	tracker *Tracker
+	repo    *git.Repository
+	store   BlockStore
+	limiter *Limiter
+
+	// Repair removes stale entries, so the next push or fetch transfers the
+	// objects again
+	Repair bool
+}
+
+func NewFsck(tracker *Tracker, repo *git.Repository, store BlockStore, limiter *Limiter) *Fsck {
+	return &Fsck{
+		log:     log.New(os.Stderr, "fsck: ", 0),
+		tracker: tracker,
+		repo:    repo,
+		store:   store,
+		limiter: limiter,
+	}
+}
+
+func (f *Fsck) Run(ctx context.Context) (*FsckReport, error) {
+	entries, err := f.tracker.ListEntries()
+	if err != nil {
+		return nil, fmt.Errorf("fsck: %v", err)
+	}
+	report := &FsckReport{Checked: len(entries)}
+
+	var lk sync.Mutex
+	errCh := make(chan error, 1)
+	wg := sizedwaitgroup.New(f.limiter.Max())
+
+	for i, sha := range entries {
+		var hash plumbing.Hash
+		copy(hash[:], sha)
+
+		err := f.repo.Storer.HasEncodedObject(hash)
+		if err != nil && err != plumbing.ErrObjectNotFound {
+			return nil, fmt.Errorf("fsck: %v", err)
+		}
+		local := err == nil
+
+		c, err := CidFromHex(hash.String())
+		if err != nil {
+			return nil, fmt.Errorf("fsck: %v", err)
+		}
+
+		if err := wg.AddWithContext(ctx); err != nil {
+			return nil, err
+		}
+		go func() {
+			defer wg.Done()
+
+			var remote bool
+			err := f.limiter.Do(ctx, func(ctx context.Context) (err error) {
+				remote, err = f.store.Has(ctx, c.String())
+				return err
+			})
+			if err != nil {
+				select {
+				case errCh <- fmt.Errorf("fsck: %s: %v", c, err):
+				default:
+				}
+				return
+			}
+
+			if !local || !remote {
+				lk.Lock()
+				report.Stale = append(report.Stale, StaleEntry{Hash: hash, Local: local, Remote: remote})
+				lk.Unlock()
+			}
+		}()
+
+		if (i+1)%100 == 0 {
+			f.log.Printf("%d/%d\r\x1b[A", i+1, len(entries))
+		}
+	}
+	wg.Wait()
+
+	select {
+	case err := <-errCh:
+		return nil, err
+	default:
+	}
+
+	sort.Slice(report.Stale, func(a, b int) bool {
+		return bytes.Compare(report.Stale[a].Hash[:], report.Stale[b].Hash[:]) < 0
+	})
+
+	if f.Repair && len(report.Stale) > 0 {
+		report.Removed, err = f.repair(entries, report.Stale)
+		if err != nil {
+			return nil, fmt.Errorf("fsck: %v", err)
+		}
+	}
+	return report, nil
+}
+
+// repair removes stale entries along with entries of all objects reaching
+// them, an entry claims everything below the object is present too
+func (f *Fsck) repair(entries [][]byte, stale []StaleEntry) (int, error) {
+	tracked := make(map[plumbing.Hash]bool, len(entries))
+	for _, sha := range entries {
+		var hash plumbing.Hash
+		copy(hash[:], sha)
+		tracked[hash] = true
+	}
+
+	parents := map[plumbing.Hash][]plumbing.Hash{}
+	for hash := range tracked {
+		raw, err := readRawObject(f.repo, hash)
+		if err == plumbing.ErrObjectNotFound {
+			// stale itself, nothing to learn about its links
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		walk, blobs, err := objectLinks(raw)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", hash, err)
+		}
+		for _, link := range append(walk, blobs...) {
+			if tracked[link] {
+				parents[link] = append(parents[link], hash)
+			}
+		}
+	}
+
+	todo := make([]plumbing.Hash, 0, len(stale))
+	for _, e := range stale {
+		todo = append(todo, e.Hash)
+	}
+
+	removed := map[plumbing.Hash]bool{}
+	for len(todo) > 0 {
+		hash := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		if removed[hash] {
+			continue
+		}
+		removed[hash] = true
+
+		if err := f.tracker.RemoveEntry(hash[:]); err != nil {
+			return 0, err
+		}
+		todo = append(todo, parents[hash]...)
+	}
+
+	return len(removed), f.tracker.Flush()
+}
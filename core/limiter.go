@@ -0,0 +1,173 @@
+package core
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultJobs is the number of parallel block store requests used when
+	// nothing is configured
+	DefaultJobs = 32
+
+	// DefaultBlockTimeout bounds a single block store request
+	DefaultBlockTimeout = 2 * time.Minute
+
+	limiterRetries = 5
+	limiterBackoff = 100 * time.Millisecond
+
+	// requests slower than slowFactor times the average, and at least
+	// slowMin, shrink the limit
+	slowFactor = 4
+	slowMin    = 50 * time.Millisecond
+)
+
+// Limiter bounds the number of concurrent requests to a block store. The
+// limit is halved when requests fail or become much slower than usual and
+// grows back by one with every normal request, up to max. Failed and timed
+// out requests are retried with exponential backoff.
+type Limiter struct {
+	lk   sync.Mutex
+	cond *sync.Cond
+
+	// Timeout of a single attempt, 0 means no timeout
+	Timeout time.Duration
+
+	max    int
+	limit  int
+	active int
+
+	// smoothed latency of successful requests
+	avg time.Duration
+}
+
+func NewLimiter(max int) *Limiter {
+	if max < 1 {
+		max = 1
+	}
+
+	l := &Limiter{
+		max:   max,
+		limit: max,
+	}
+	l.cond = sync.NewCond(&l.lk)
+	return l
+}
+
+// Max returns the configured upper bound
+func (l *Limiter) Max() int {
+	return l.max
+}
+
+// Limit returns the current limit
+func (l *Limiter) Limit() int {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	return l.limit
+}
+
+// Do runs fn once a slot is available, retrying errors which may be
+// transient. It gives up as soon as ctx is done.
+func (l *Limiter) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	backoff := limiterBackoff
+	for attempt := 1; ; attempt++ {
+		if err := l.acquire(ctx); err != nil {
+			return err
+		}
+
+		start := time.Now()
+		err := l.attempt(ctx, fn)
+		l.release(err, time.Since(start))
+
+		if err == nil || attempt == limiterRetries || !retryable(err) {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+func (l *Limiter) attempt(ctx context.Context, fn func(ctx context.Context) error) error {
+	if l.Timeout == 0 {
+		return fn(ctx)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, l.Timeout)
+	defer cancel()
+	return fn(ctx)
+}
+
+func (l *Limiter) acquire(ctx context.Context) error {
+	// wake up waiters when ctx is done, cond has no other way to select
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.lk.Lock()
+			l.cond.Broadcast()
+			l.lk.Unlock()
+		case <-stop:
+		}
+	}()
+
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	for l.active >= l.limit {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		l.cond.Wait()
+	}
+	l.active++
+	return nil
+}
+
+func (l *Limiter) release(err error, took time.Duration) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	l.active--
+	defer l.cond.Broadcast()
+
+	if err != nil && retryable(err) {
+		l.shrink()
+		return
+	}
+
+	if l.avg != 0 && took > l.avg*slowFactor && took > slowMin {
+		l.shrink()
+	} else if l.limit < l.max {
+		l.limit++
+	}
+
+	if l.avg == 0 {
+		l.avg = took
+	} else {
+		l.avg = (l.avg*7 + took) / 8
+	}
+}
+
+func (l *Limiter) shrink() {
+	l.limit /= 2
+	if l.limit < 1 {
+		l.limit = 1
+	}
+}
+
+// retryable tells errors of the backend apart from missing blocks and other
+// permanent failures. Attempts which ran out of time are retried too.
+func retryable(err error) bool {
+	return err != ErrReadOnly && err != context.Canceled && !isNotFound(err)
+}
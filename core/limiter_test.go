@@ -0,0 +1,79 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLimiterBackoff(t *testing.T) {
+	l := NewLimiter(8)
+
+	calls := 0
+	err := l.Do(context.Background(), func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 attempts, got %d", calls)
+	}
+
+	// two failures halved the limit, the success added one back
+	if l.Limit() != 3 {
+		t.Fatalf("unexpected limit %d", l.Limit())
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := l.Do(context.Background(), func(ctx context.Context) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if l.Limit() != 8 {
+		t.Fatalf("limit didn't recover: %d", l.Limit())
+	}
+}
+
+func TestLimiterPermanentError(t *testing.T) {
+	l := NewLimiter(8)
+
+	calls := 0
+	err := l.Do(context.Background(), func(ctx context.Context) error {
+		calls++
+		return errors.New("block abc not found")
+	})
+	if err == nil || calls != 1 {
+		t.Fatalf("missing blocks must not be retried: %d calls, %v", calls, err)
+	}
+	if l.Limit() != 8 {
+		t.Fatalf("missing block shrank the limit to %d", l.Limit())
+	}
+}
+
+func TestLimiterTimeout(t *testing.T) {
+	l := NewLimiter(8)
+	l.Timeout = 10 * time.Millisecond
+
+	calls := 0
+	err := l.Do(context.Background(), func(ctx context.Context) error {
+		calls++
+		if calls == 1 {
+			// hung request, only the attempt timeout ends it
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Fatalf("expected a retry after timeout, got %d calls", calls)
+	}
+}
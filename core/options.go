@@ -0,0 +1,94 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Options holds values set by git through the `option` command
+type Options struct {
+	// Verbosity 0 is quiet, 1 is the default, protocol traces show from 2
+	Verbosity int
+	Progress  bool
+	DryRun    bool
+
+	// Depth and DeepenSince limit history of fetched commits, zero values
+	// mean full history
+	Depth       int
+	DeepenSince time.Time
+
+	// FollowTags is informational, git adds the tags to push itself
+	FollowTags bool
+}
+
+func defaultOptions() Options {
+	return Options{
+		Verbosity: 1,
+		Progress:  true,
+	}
+}
+
+// set applies a single option and returns the response for git, rejected
+// values leave the option as it was
+func (o *Options) set(name, value string) string {
+	var err error
+	switch name {
+	case "verbosity":
+		var v int
+		if v, err = strconv.Atoi(value); err == nil {
+			o.Verbosity = v
+		}
+	case "progress":
+		err = setBool(&o.Progress, value)
+	case "dry-run":
+		err = setBool(&o.DryRun, value)
+	case "depth":
+		var depth int
+		depth, err = strconv.Atoi(value)
+		if err == nil && depth < 0 {
+			err = fmt.Errorf("negative depth")
+		}
+		if err == nil {
+			o.Depth = depth
+		}
+	case "deepen-since":
+		var since time.Time
+		if since, err = parseSince(value); err == nil {
+			o.DeepenSince = since
+		}
+	case "followtags":
+		err = setBool(&o.FollowTags, value)
+	default:
+		return "unsupported"
+	}
+
+	if err != nil {
+		return fmt.Sprintf("error invalid value for %s: %q", name, value)
+	}
+	return "ok"
+}
+
+func setBool(dst *bool, value string) error {
+	v, err := strconv.ParseBool(value)
+	if err == nil {
+		*dst = v
+	}
+	return err
+}
+
+var sinceLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"}
+
+// parseSince accepts a unix timestamp, as sent by git, or a plain date
+func parseSince(value string) (time.Time, error) {
+	if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(ts, 0), nil
+	}
+
+	for _, layout := range sinceLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", value)
+}
@@ -0,0 +1,22 @@
+package core
+
+import "testing"
+
+func TestOptionsRejectedValue(t *testing.T) {
+	o := defaultOptions()
+	for _, opt := range [][2]string{{"depth", "3"}, {"verbosity", "2"}, {"dry-run", "true"}} {
+		if res := o.set(opt[0], opt[1]); res != "ok" {
+			t.Fatalf("%s: %s", opt[0], res)
+		}
+	}
+
+	for _, opt := range [][2]string{{"depth", "-1"}, {"depth", "x"}, {"verbosity", "loud"}, {"dry-run", "maybe"}, {"deepen-since", "someday"}} {
+		if res := o.set(opt[0], opt[1]); res == "ok" {
+			t.Fatalf("%s %s accepted", opt[0], opt[1])
+		}
+	}
+
+	if o.Depth != 3 || o.Verbosity != 2 || !o.DryRun || !o.DeepenSince.IsZero() {
+		t.Fatalf("rejected values changed options: %+v", o)
+	}
+}
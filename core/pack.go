@@ -0,0 +1,328 @@
+package core
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/idxfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+)
+
+const (
+	packHeaderSize = 12
+
+	// deltaWindow is the number of recent objects of each type tried as delta
+	// bases, objects above maxDeltaSize are always stored whole
+	deltaWindow   = 10
+	maxDeltaDepth = 50
+	maxDeltaSize  = 1 << 20
+)
+
+var errPackClosed = errors.New("pack already closed")
+
+type deltaBase struct {
+	offset int64
+	data   []byte
+	depth  int
+}
+
+// PackWriter streams git objects into a temporary packfile in the order they
+// are added. Finish writes the header, trailer and index and moves both into
+// objects/pack.
+type PackWriter struct {
+	lk sync.Mutex
+
+	packDir string
+	tmp     *os.File
+	offset  int64
+	idx     *idxfile.Writer
+	count   uint32
+
+	// Deltas enables OFS_DELTA compression against recently added objects
+	Deltas bool
+	window map[plumbing.ObjectType][]*deltaBase
+}
+
+func NewPackWriter(objectDir string) (*PackWriter, error) {
+	packDir := path.Join(objectDir, "pack")
+	if err := os.MkdirAll(packDir, 0777); err != nil {
+		return nil, err
+	}
+
+	tmp, err := ioutil.TempFile(packDir, "tmp_pack_")
+	if err != nil {
+		return nil, err
+	}
+
+	// header is rewritten once the object count is known
+	if _, err := tmp.Write(make([]byte, packHeaderSize)); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	return &PackWriter{
+		packDir: packDir,
+		tmp:     tmp,
+		offset:  packHeaderSize,
+		idx:     new(idxfile.Writer),
+		window:  map[plumbing.ObjectType][]*deltaBase{},
+	}, nil
+}
+
+// Add appends a raw git object, as stored in IPLD, to the pack
+func (w *PackWriter) Add(hash string, object []byte) error {
+	h, err := hex.DecodeString(hash)
+	if err != nil {
+		return err
+	}
+
+	typ, data, err := splitObject(object)
+	if err != nil {
+		return err
+	}
+
+	w.lk.Lock()
+	defer w.lk.Unlock()
+
+	if w.tmp == nil {
+		return errPackClosed
+	}
+
+	entry, base := w.delta(typ, data)
+
+	var buf bytes.Buffer
+	if base != nil {
+		buf.Write(packEntryHeader(plumbing.OFSDeltaObject, int64(len(entry))))
+		buf.Write(packDeltaOffset(w.offset - base.offset))
+	} else {
+		buf.Write(packEntryHeader(typ, int64(len(data))))
+	}
+
+	zw := zlib.NewWriter(&buf)
+	if _, err := zw.Write(entry); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	if _, err := w.tmp.Write(buf.Bytes()); err != nil {
+		// a partially written entry would corrupt the pack
+		w.close()
+		return err
+	}
+
+	var ph plumbing.Hash
+	copy(ph[:], h)
+	w.idx.Add(ph, uint64(w.offset), crc32.ChecksumIEEE(buf.Bytes()))
+
+	if w.Deltas && len(data) <= maxDeltaSize && (typ == plumbing.BlobObject || typ == plumbing.TreeObject) {
+		depth := 0
+		if base != nil {
+			depth = base.depth + 1
+		}
+
+		win := append(w.window[typ], &deltaBase{offset: w.offset, data: data, depth: depth})
+		if len(win) > deltaWindow {
+			win = win[1:]
+		}
+		w.window[typ] = win
+	}
+
+	w.offset += int64(buf.Len())
+	w.count++
+	return nil
+}
+
+// delta picks the best delta base for data from the window. It returns data
+// itself and a nil base when storing the object whole is cheaper.
+func (w *PackWriter) delta(typ plumbing.ObjectType, data []byte) ([]byte, *deltaBase) {
+	if !w.Deltas || len(data) > maxDeltaSize {
+		return data, nil
+	}
+
+	entry := data
+	var best *deltaBase
+	for _, base := range w.window[typ] {
+		if base.depth >= maxDeltaDepth {
+			continue
+		}
+
+		// DiffDelta returns a pooled buffer, reused by the next call
+		delta := packfile.DiffDelta(base.data, data)
+		if len(delta) < len(data)/2 && len(delta) < len(entry) {
+			entry, best = append([]byte(nil), delta...), base
+		}
+	}
+	return entry, best
+}
+
+// Size returns the number of bytes written so far
+func (w *PackWriter) Size() int64 {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+
+	return w.offset
+}
+
+// Len returns the number of objects added so far
+func (w *PackWriter) Len() int {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+
+	return int(w.count)
+}
+
+// Finish completes the pack and its index and makes them visible to git. An
+// empty pack is discarded.
+func (w *PackWriter) Finish() error {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+
+	if w.tmp == nil {
+		return errPackClosed
+	}
+	if w.count == 0 {
+		return w.close()
+	}
+
+	hdr := make([]byte, 0, packHeaderSize)
+	hdr = append(hdr, "PACK"...)
+	hdr = append(hdr, 0, 0, 0, 2)
+	hdr = append(hdr, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(hdr[8:], w.count)
+	if _, err := w.tmp.WriteAt(hdr, 0); err != nil {
+		return err
+	}
+
+	if _, err := w.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	sum := sha1.New()
+	if _, err := io.Copy(sum, w.tmp); err != nil {
+		return err
+	}
+
+	var checksum plumbing.Hash
+	copy(checksum[:], sum.Sum(nil))
+	if _, err := w.tmp.Write(checksum[:]); err != nil {
+		return err
+	}
+
+	if err := w.idx.OnFooter(checksum); err != nil {
+		return err
+	}
+	idx, err := w.idx.Index()
+	if err != nil {
+		return err
+	}
+
+	var idxBuf bytes.Buffer
+	if _, err := idxfile.NewEncoder(&idxBuf).Encode(idx); err != nil {
+		return err
+	}
+
+	if err := w.tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(w.tmp.Name(), 0444); err != nil {
+		return err
+	}
+
+	base := path.Join(w.packDir, "pack-"+checksum.String())
+	if err := os.Rename(w.tmp.Name(), base+".pack"); err != nil {
+		return err
+	}
+	w.tmp = nil
+
+	// git only picks up packs with an index, write it last
+	tmpIdx := base + ".idx.tmp"
+	if err := ioutil.WriteFile(tmpIdx, idxBuf.Bytes(), 0444); err != nil {
+		return err
+	}
+	return os.Rename(tmpIdx, base+".idx")
+}
+
+// Close discards the pack, it's a no-op after Finish
+func (w *PackWriter) Close() error {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+
+	return w.close()
+}
+
+func (w *PackWriter) close() error {
+	if w.tmp == nil {
+		return nil
+	}
+
+	w.tmp.Close()
+	err := os.Remove(w.tmp.Name())
+	w.tmp = nil
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// splitObject parses the "<type> <size>\x00" header of a raw git object
+func splitObject(object []byte) (plumbing.ObjectType, []byte, error) {
+	nul := bytes.IndexByte(object, 0)
+	sp := bytes.IndexByte(object, ' ')
+	if nul < 0 || sp < 0 || sp > nul {
+		return plumbing.InvalidObject, nil, fmt.Errorf("malformed object header")
+	}
+
+	typ, err := plumbing.ParseObjectType(string(object[:sp]))
+	if err != nil {
+		return plumbing.InvalidObject, nil, err
+	}
+
+	size, err := strconv.Atoi(string(object[sp+1 : nul]))
+	if err != nil {
+		return plumbing.InvalidObject, nil, err
+	}
+
+	data := object[nul+1:]
+	if size != len(data) {
+		return plumbing.InvalidObject, nil, fmt.Errorf("object size mismatch: %d != %d", size, len(data))
+	}
+	return typ, data, nil
+}
+
+func packEntryHeader(typ plumbing.ObjectType, size int64) []byte {
+	b := byte(typ)<<4 | byte(size&0x0f)
+	size >>= 4
+
+	out := make([]byte, 0, 10)
+	for size != 0 {
+		out = append(out, b|0x80)
+		b = byte(size & 0x7f)
+		size >>= 7
+	}
+	return append(out, b)
+}
+
+// packDeltaOffset encodes the distance to an OFS_DELTA base
+func packDeltaOffset(n int64) []byte {
+	out := []byte{byte(n & 0x7f)}
+	for n >>= 7; n != 0; n >>= 7 {
+		n--
+		out = append([]byte{byte(0x80 | n&0x7f)}, out...)
+	}
+	return out
+}
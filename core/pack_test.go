@@ -0,0 +1,255 @@
+package core
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/idxfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/objfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+)
+
+func TestPackWriter(t *testing.T) {
+	for _, deltas := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "pack-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		repo, err := git.PlainInit(dir, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w, err := NewPackWriter(filepath.Join(dir, "objects"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Deltas = deltas
+
+		// similar blobs so some are stored as deltas
+		objects := map[string][]byte{}
+		for i := 0; i < 30; i++ {
+			content := strings.Repeat("hello world\n", 100+i) + fmt.Sprintf("line %d\n", i)
+			object := []byte(fmt.Sprintf("blob %d\x00%s", len(content), content))
+
+			sum := sha1.Sum(object)
+			hash := hex.EncodeToString(sum[:])
+			objects[hash] = object
+
+			if err := w.Add(hash, object); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := w.Finish(); err != nil {
+			t.Fatal(err)
+		}
+
+		packs, _ := filepath.Glob(filepath.Join(dir, "objects", "pack", "*"))
+		if len(packs) != 2 {
+			t.Fatalf("deltas=%t: expected pack and index, got %v", deltas, packs)
+		}
+
+		for hash, object := range objects {
+			obj, err := repo.Storer.EncodedObject(plumbing.BlobObject, plumbing.NewHash(hash))
+			if err != nil {
+				t.Fatalf("deltas=%t: %s: %v", deltas, hash, err)
+			}
+
+			r, err := obj.Reader()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.HasSuffix(object, data) || len(object)-len(data) != bytes.IndexByte(object, 0)+1 {
+				t.Fatalf("deltas=%t: %s: unexpected contents", deltas, hash)
+			}
+		}
+
+		// read back in pack order, resolving deltas ourselves
+		r, err := newPackReader(filepath.Join(dir, "objects"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hashes := make([]plumbing.Hash, 0, len(objects))
+		for hash := range objects {
+			hashes = append(hashes, plumbing.NewHash(hash))
+		}
+
+		read := 0
+		err = r.Stream(hashes, func(hash plumbing.Hash, raw []byte) error {
+			read++
+			if !bytes.Equal(raw, objects[hash.String()]) {
+				return fmt.Errorf("%s: unexpected contents", hash)
+			}
+			return nil
+		})
+		r.Close()
+		if err != nil {
+			t.Fatalf("deltas=%t: %v", deltas, err)
+		}
+		if read != len(objects) {
+			t.Fatalf("deltas=%t: read %d of %d objects", deltas, read, len(objects))
+		}
+	}
+}
+
+func TestPackWriterEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pack-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := NewPackWriter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries, _ := ioutil.ReadDir(filepath.Join(dir, "pack")); len(entries) != 0 {
+		t.Fatalf("empty pack left %d files", len(entries))
+	}
+}
+
+// writeRefDeltaPack writes a pack holding only target, as a REF_DELTA
+// against a base the pack leaves out
+func writeRefDeltaPack(t *testing.T, objectDir string, base, target []byte) {
+	baseHash := plumbing.ComputeHash(plumbing.BlobObject, base)
+	delta := packfile.DiffDelta(base, target)
+
+	var pack bytes.Buffer
+	pack.WriteString("PACK")
+	binary.Write(&pack, binary.BigEndian, [2]uint32{2, 1})
+
+	pack.Write(packEntryHeader(plumbing.REFDeltaObject, int64(len(delta))))
+	pack.Write(baseHash[:])
+	zw := zlib.NewWriter(&pack)
+	zw.Write(delta)
+	zw.Close()
+	crc := crc32.ChecksumIEEE(pack.Bytes()[12:])
+
+	sum := sha1.Sum(pack.Bytes())
+	pack.Write(sum[:])
+
+	var iw idxfile.Writer
+	iw.OnHeader(1)
+	iw.Add(plumbing.ComputeHash(plumbing.BlobObject, target), 12, crc)
+	if err := iw.OnFooter(plumbing.Hash(sum)); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := iw.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := filepath.Join(objectDir, "pack", "pack-"+hex.EncodeToString(sum[:]))
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name+".pack", pack.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Create(name + ".idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := idxfile.NewEncoder(f).Encode(idx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeLoose(t *testing.T, objectDir string, data []byte) {
+	hash := plumbing.ComputeHash(plumbing.BlobObject, data).String()
+	p := filepath.Join(objectDir, hash[:2], hash[2:])
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w := objfile.NewWriter(f)
+	if err := w.WriteHeader(plumbing.BlobObject, int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPackReaderExternalBase(t *testing.T) {
+	base := []byte(strings.Repeat("hello world\n", 100))
+	target := append(append([]byte{}, base...), "one more line\n"...)
+	raw := append([]byte(fmt.Sprintf("blob %d\x00", len(target))), target...)
+
+	for _, loose := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "pack-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		objectDir := filepath.Join(dir, "objects")
+
+		// the base is in another pack, or a loose object
+		if loose {
+			writeLoose(t, objectDir, base)
+		} else {
+			w, err := NewPackWriter(objectDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			object := append([]byte(fmt.Sprintf("blob %d\x00", len(base))), base...)
+			if err := w.Add(plumbing.ComputeHash(plumbing.BlobObject, base).String(), object); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Finish(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		writeRefDeltaPack(t, objectDir, base, target)
+
+		r, err := newPackReader(objectDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, found, err := r.Read(plumbing.ComputeHash(plumbing.BlobObject, target))
+		r.Close()
+		if err != nil || !found {
+			t.Fatalf("loose=%t: found=%t: %v", loose, found, err)
+		}
+		if !bytes.Equal(data, raw) {
+			t.Fatalf("loose=%t: unexpected contents", loose)
+		}
+	}
+}
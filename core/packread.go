@@ -0,0 +1,336 @@
+package core
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/idxfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/objfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+)
+
+// deltaCacheSize limits memory held by resolved delta bases
+const deltaCacheSize = 96 << 20
+
+type packIndex struct {
+	path string
+	idx  *idxfile.MemoryIndex
+
+	// opened on first use
+	file    *os.File
+	scanner *packfile.Scanner
+}
+
+// packReader reads raw git objects straight out of the repository packs,
+// resolving deltas through a cache of recently used bases
+type packReader struct {
+	objectDir string
+	packs     []*packIndex
+	cache     *baseCache
+}
+
+type packObject struct {
+	typ  plumbing.ObjectType
+	data []byte
+}
+
+func newPackReader(objectDir string) (*packReader, error) {
+	packDir := path.Join(objectDir, "pack")
+	entries, err := ioutil.ReadDir(packDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	r := &packReader{
+		objectDir: objectDir,
+		cache:     newBaseCache(deltaCacheSize),
+	}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".idx") {
+			continue
+		}
+
+		f, err := os.Open(path.Join(packDir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		idx := idxfile.NewMemoryIndex()
+		err = idxfile.NewDecoder(f).Decode(idx)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", e.Name(), err)
+		}
+
+		r.packs = append(r.packs, &packIndex{
+			path: path.Join(packDir, strings.TrimSuffix(e.Name(), ".idx")+".pack"),
+			idx:  idx,
+		})
+	}
+	return r, nil
+}
+
+// Read returns a single object, found is false if no pack contains it
+func (r *packReader) Read(hash plumbing.Hash) (raw []byte, found bool, err error) {
+	err = r.Stream([]plumbing.Hash{hash}, func(_ plumbing.Hash, obj []byte) error {
+		raw = obj
+		return nil
+	})
+	return raw, raw != nil, err
+}
+
+// Stream calls fn with raw objects for all hashes found in packs, pack by pack
+// in pack order, so delta chains are resolved front to back. Hashes not in
+// any pack are skipped.
+func (r *packReader) Stream(hashes []plumbing.Hash, fn func(hash plumbing.Hash, raw []byte) error) error {
+	type located struct {
+		hash   plumbing.Hash
+		offset int64
+	}
+	byPack := make([][]located, len(r.packs))
+
+	for _, h := range hashes {
+		for i, p := range r.packs {
+			offset, err := p.idx.FindOffset(h)
+			if err == plumbing.ErrObjectNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			byPack[i] = append(byPack[i], located{h, offset})
+			break
+		}
+	}
+
+	for i, objs := range byPack {
+		if len(objs) == 0 {
+			continue
+		}
+
+		sort.Slice(objs, func(a, b int) bool { return objs[a].offset < objs[b].offset })
+
+		err := r.withPack(i, func(s *packfile.Scanner) error {
+			for _, o := range objs {
+				obj, err := r.readAt(i, s, o.offset)
+				if err != nil {
+					return fmt.Errorf("%s: %v", o.hash, err)
+				}
+
+				raw := append([]byte(fmt.Sprintf("%s %d\x00", obj.typ, len(obj.data))), obj.data...)
+				if err := fn(o.hash, raw); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *packReader) withPack(i int, fn func(s *packfile.Scanner) error) error {
+	p := r.packs[i]
+	if p.file == nil {
+		f, err := os.Open(p.path)
+		if err != nil {
+			return err
+		}
+
+		p.file = f
+		p.scanner = packfile.NewScanner(f)
+	}
+
+	return fn(p.scanner)
+}
+
+// Close closes pack files opened by reads
+func (r *packReader) Close() error {
+	var err error
+	for _, p := range r.packs {
+		if p.file == nil {
+			continue
+		}
+
+		if cerr := p.file.Close(); cerr != nil {
+			err = cerr
+		}
+		p.file = nil
+	}
+	return err
+}
+
+// readAt reads the object at offset of pack i, applying deltas
+func (r *packReader) readAt(i int, s *packfile.Scanner, offset int64) (*packObject, error) {
+	if obj := r.cache.get(i, offset); obj != nil {
+		return obj, nil
+	}
+
+	hdr, err := s.SeekObjectHeader(offset)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if _, _, err := s.NextObject(&buf); err != nil {
+		return nil, err
+	}
+
+	var base *packObject
+	switch hdr.Type {
+	case plumbing.OFSDeltaObject:
+		base, err = r.readAt(i, s, hdr.OffsetReference)
+	case plumbing.REFDeltaObject:
+		base, err = r.readBase(i, s, hdr.Reference)
+	default:
+		obj := &packObject{typ: hdr.Type, data: buf.Bytes()}
+		r.cache.put(i, offset, obj)
+		return obj, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("delta base: %v", err)
+	}
+
+	data, err := packfile.PatchDelta(base.data, buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	obj := &packObject{typ: base.typ, data: data}
+	r.cache.put(i, offset, obj)
+	return obj, nil
+}
+
+// readBase reads the base of a REF_DELTA in pack i. Packs written by git
+// fetch or repack may leave it to another pack or a loose object.
+func (r *packReader) readBase(i int, s *packfile.Scanner, hash plumbing.Hash) (*packObject, error) {
+	offset, err := r.packs[i].idx.FindOffset(hash)
+	if err == nil {
+		return r.readAt(i, s, offset)
+	}
+	if err != plumbing.ErrObjectNotFound {
+		return nil, err
+	}
+
+	for j, p := range r.packs {
+		if j == i {
+			continue
+		}
+
+		offset, err := p.idx.FindOffset(hash)
+		if err == plumbing.ErrObjectNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var obj *packObject
+		err = r.withPack(j, func(s *packfile.Scanner) error {
+			obj, err = r.readAt(j, s, offset)
+			return err
+		})
+		return obj, err
+	}
+
+	return r.readLoose(hash)
+}
+
+func (r *packReader) readLoose(hash plumbing.Hash) (*packObject, error) {
+	h := hash.String()
+	f, err := os.Open(path.Join(r.objectDir, h[:2], h[2:]))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: %v", hash, plumbing.ErrObjectNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	or, err := objfile.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer or.Close()
+
+	typ, _, err := or.Header()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(or)
+	if err != nil {
+		return nil, err
+	}
+	return &packObject{typ: typ, data: data}, nil
+}
+
+type cacheKey struct {
+	pack   int
+	offset int64
+}
+
+type cacheEntry struct {
+	key cacheKey
+	obj *packObject
+}
+
+// baseCache is a LRU cache of resolved pack objects bounded by total size
+type baseCache struct {
+	max  int
+	size int
+
+	lru     *list.List
+	entries map[cacheKey]*list.Element
+}
+
+func newBaseCache(max int) *baseCache {
+	return &baseCache{
+		max:     max,
+		lru:     list.New(),
+		entries: map[cacheKey]*list.Element{},
+	}
+}
+
+func (c *baseCache) get(pack int, offset int64) *packObject {
+	e, ok := c.entries[cacheKey{pack, offset}]
+	if !ok {
+		return nil
+	}
+
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).obj
+}
+
+func (c *baseCache) put(pack int, offset int64, obj *packObject) {
+	if len(obj.data) > c.max {
+		return
+	}
+
+	key := cacheKey{pack, offset}
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key, obj})
+	c.size += len(obj.data)
+
+	for c.size > c.max {
+		e := c.lru.Back()
+		ent := e.Value.(*cacheEntry)
+
+		c.lru.Remove(e)
+		delete(c.entries, ent.key)
+		c.size -= len(ent.obj.data)
+	}
+}
@@ -0,0 +1,171 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	PinQueued  = "queued"
+	PinPinning = "pinning"
+	PinPinned  = "pinned"
+	PinFailed  = "failed"
+
+	// status checks start after minPollInterval and back off up to the
+	// poll interval
+	minPollInterval     = 100 * time.Millisecond
+	defaultPollInterval = 2 * time.Second
+)
+
+// Pin is an object of the IPFS Pinning Service API
+type Pin struct {
+	Cid     string            `json:"cid"`
+	Name    string            `json:"name,omitempty"`
+	Origins []string          `json:"origins,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"`
+}
+
+// PinStatus is the state of a pin request
+type PinStatus struct {
+	RequestID string    `json:"requestid"`
+	Status    string    `json:"status"`
+	Created   time.Time `json:"created"`
+	Pin       Pin       `json:"pin"`
+	Delegates []string  `json:"delegates"`
+}
+
+// PinService is a client of a remote pinning service speaking the IPFS
+// Pinning Service API
+type PinService struct {
+	endpoint string
+	token    string
+	client   *http.Client
+
+	// PollInterval is the longest time between status checks of Wait
+	PollInterval time.Duration
+}
+
+func NewPinService(endpoint, token string) *PinService {
+	return &PinService{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		token:    token,
+		client:   http.DefaultClient,
+
+		PollInterval: defaultPollInterval,
+	}
+}
+
+// Add requests pin, the service pins it in the background
+func (s *PinService) Add(ctx context.Context, pin Pin) (*PinStatus, error) {
+	var status PinStatus
+	if err := s.do(ctx, http.MethodPost, "/pins", pin, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Status returns the current state of a request
+func (s *PinService) Status(ctx context.Context, requestID string) (*PinStatus, error) {
+	var status PinStatus
+	if err := s.do(ctx, http.MethodGet, "/pins/"+requestID, nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Remove removes the pin of a request
+func (s *PinService) Remove(ctx context.Context, requestID string) error {
+	return s.do(ctx, http.MethodDelete, "/pins/"+requestID, nil, nil)
+}
+
+// Wait polls the request until it's pinned or failed, or ctx is done. The
+// last known status is returned either way.
+func (s *PinService) Wait(ctx context.Context, status *PinStatus) (*PinStatus, error) {
+	interval := minPollInterval
+	for status.Status == PinQueued || status.Status == PinPinning {
+		if interval > s.PollInterval {
+			interval = s.PollInterval
+		}
+
+		select {
+		case <-ctx.Done():
+			return status, ctx.Err()
+		case <-time.After(interval):
+		}
+		interval *= 2
+
+		next, err := s.Status(ctx, status.RequestID)
+		if err != nil && ctx.Err() != nil {
+			return status, ctx.Err()
+		}
+		if err != nil {
+			return status, err
+		}
+		status = next
+	}
+	return status, nil
+}
+
+func (s *PinService) do(ctx context.Context, method, p string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, s.endpoint+p, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		var failure struct {
+			Error struct {
+				Reason  string `json:"reason"`
+				Details string `json:"details"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(data, &failure) == nil && failure.Error.Reason != "" {
+			if failure.Error.Details != "" {
+				return fmt.Errorf("pinning service: %s: %s", failure.Error.Reason, failure.Error.Details)
+			}
+			return fmt.Errorf("pinning service: %s", failure.Error.Reason)
+		}
+		return fmt.Errorf("pinning service: %s", resp.Status)
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("pinning service: %v", err)
+	}
+	return nil
+}
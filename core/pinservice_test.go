@@ -0,0 +1,153 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pinServiceMock is a stand-in pinning service, requests turn pinned after
+// being polled a few times
+type pinServiceMock struct {
+	lk    sync.Mutex
+	token string
+	polls int
+
+	requests map[string]*PinStatus
+	checks   map[string]int
+}
+
+func newPinServiceMock(token string, polls int) *httptest.Server {
+	m := &pinServiceMock{
+		token:    token,
+		polls:    polls,
+		requests: map[string]*PinStatus{},
+		checks:   map[string]int{},
+	}
+	return httptest.NewServer(m)
+}
+
+func (m *pinServiceMock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	if m.token != "" && r.Header.Get("Authorization") != "Bearer "+m.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error": {"reason": "UNAUTHORIZED", "details": "bad token"}}`)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/pins/")
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/pins":
+		var pin Pin
+		if err := json.NewDecoder(r.Body).Decode(&pin); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		status := &PinStatus{
+			RequestID: fmt.Sprintf("req%d", len(m.requests)+1),
+			Status:    PinQueued,
+			Created:   time.Now(),
+			Pin:       pin,
+		}
+		if pin.Cid == "bad" {
+			status.Status = PinFailed
+		}
+		m.requests[status.RequestID] = status
+
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(status)
+	case r.Method == http.MethodGet && m.requests[id] != nil:
+		status := m.requests[id]
+		m.checks[id]++
+		if status.Status != PinFailed {
+			status.Status = PinPinning
+			if m.checks[id] >= m.polls {
+				status.Status = PinPinned
+			}
+		}
+		json.NewEncoder(w).Encode(status)
+	case r.Method == http.MethodDelete && m.requests[id] != nil:
+		delete(m.requests, id)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error": {"reason": "NOT_FOUND"}}`)
+	}
+}
+
+func TestPinService(t *testing.T) {
+	srv := newPinServiceMock("secret", 3)
+	defer srv.Close()
+
+	service := NewPinService(srv.URL, "secret")
+	service.PollInterval = time.Millisecond
+
+	ctx := context.Background()
+	status, err := service.Add(ctx, Pin{Cid: "QmRoot", Name: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != PinQueued || status.RequestID == "" {
+		t.Fatalf("unexpected initial status %+v", status)
+	}
+
+	status, err = service.Wait(ctx, status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != PinPinned || status.Pin.Cid != "QmRoot" {
+		t.Fatalf("unexpected final status %+v", status)
+	}
+
+	if err := service.Remove(ctx, status.RequestID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.Status(ctx, status.RequestID); err == nil || !strings.Contains(err.Error(), "NOT_FOUND") {
+		t.Fatalf("expected removed request to be gone, got %v", err)
+	}
+
+	failed, err := service.Add(ctx, Pin{Cid: "bad"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed, err = service.Wait(ctx, failed); err != nil || failed.Status != PinFailed {
+		t.Fatalf("expected failed pin, got %+v: %v", failed, err)
+	}
+
+	_, err = NewPinService(srv.URL, "wrong").Add(ctx, Pin{Cid: "QmRoot"})
+	if err == nil || !strings.Contains(err.Error(), "UNAUTHORIZED: bad token") {
+		t.Fatalf("expected auth error, got %v", err)
+	}
+}
+
+func TestPinServiceWaitTimeout(t *testing.T) {
+	srv := newPinServiceMock("", 1000)
+	defer srv.Close()
+
+	service := NewPinService(srv.URL, "")
+	service.PollInterval = time.Millisecond
+
+	status, err := service.Add(context.Background(), Pin{Cid: "QmRoot"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	status, err = service.Wait(ctx, status)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+	if status.Status != PinPinning {
+		t.Fatalf("expected last known status, got %s", status.Status)
+	}
+}
@@ -2,244 +2,545 @@ package core
 
 import (
 	"container/list"
-	"encoding/hex"
-	"errors"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/signal"
 	"path"
+	"sync"
 
 	cid "github.com/ipfs/go-cid"
-	ipfs "github.com/ipfs/go-ipfs-api"
-	ipldgit "github.com/ipfs/go-ipld-git"
-	mh "github.com/multiformats/go-multihash"
 	sizedwaitgroup "github.com/remeh/sizedwaitgroup"
 	git "gopkg.in/src-d/go-git.v4"
 	plumbing "gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
 )
 
+// pushCheckpoint is the number of stored objects after which progress of
+// a push is made durable
+const pushCheckpoint = 1000
+
+// pushNode follows an object through the push until it and everything it
+// links to is stored
+type pushNode struct {
+	// missing counts linked objects which aren't confirmed yet
+	missing int
+	parents []plumbing.Hash
+
+	stored bool
+	marked bool
+	done   bool
+}
+
 type Push struct {
 	objectDir string
 	gitDir    string
 
 	done    uint64
 	todoc   uint64
-	todo    *list.List
 	log     *log.Logger
 	tracker *Tracker
 	repo    *git.Repository
-
-	processing map[string]int
-	subs       map[string][][]byte
+	store   BlockStore
+	limiter *Limiter
+	packs   *packReader
+
+	// objects are added to the tracker as soon as they and everything they
+	// link to is stored, lk guards graph and tracker once puts run
+	lk    sync.Mutex
+	graph map[plumbing.Hash]*pushNode
+	base  plumbing.Hash
+
+	// stored counts objects stored by this push, recovered ones stored by an
+	// interrupted push of the same base
+	stored    uint64
+	recovered uint64
+	unflushed int
 
 	errCh chan error
 	wg    sizedwaitgroup.SizedWaitGroup
 
+	// DryRun walks the graph without storing blocks or updating the tracker
+	DryRun  bool
+	dryDone map[string]bool
+
+	objects uint64
+	bytes   uint64
+
 	NewNode func(hash cid.Cid, data []byte) error
 }
 
-func NewPush(gitDir string, tracker *Tracker, repo *git.Repository) *Push {
+func NewPush(gitDir string, tracker *Tracker, repo *git.Repository, store BlockStore, limiter *Limiter) *Push {
 	return &Push{
 		objectDir: path.Join(gitDir, "objects"),
 		gitDir:    gitDir,
 
-		todo:    list.New(),
 		log:     log.New(os.Stderr, "push: ", 0),
 		tracker: tracker,
 		repo:    repo,
-		todoc:   1,
+		store:   store,
+		limiter: limiter,
 
-		processing: map[string]int{},
-		subs:       map[string][][]byte{},
+		dryDone: map[string]bool{},
+		graph:   map[plumbing.Hash]*pushNode{},
 
-		wg:    sizedwaitgroup.New(512),
-		errCh: make(chan error),
+		wg:    sizedwaitgroup.New(limiter.Max()),
+		errCh: make(chan error, 1),
 	}
 }
 
-func (p *Push) PushHash(hash string) error {
-	p.todo.PushFront(hash)
-	return p.doWork()
-}
+func (p *Push) PushHash(ctx context.Context, hash string) error {
+	packs, err := newPackReader(p.objectDir)
+	if err != nil {
+		return fmt.Errorf("push: %v", err)
+	}
+	p.packs = packs
+	defer packs.Close()
 
-func (p *Push) doWork() error {
-	defer p.wg.Wait()
+	p.base = plumbing.NewHash(hash)
 
-	api := ipfs.NewLocalShell()
+	// stop pending puts on the way out
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	intch := make(chan os.Signal, 1)
-	signal.Notify(intch, os.Interrupt)
-	go func() {
-		<-intch
-		p.errCh <- errors.New("interrupted")
-	}()
-	defer signal.Stop(intch)
+	err = p.doWork(ctx)
+	cancel()
+	p.wg.Wait()
 
-	for e := p.todo.Front(); e != nil; e = e.Next() {
-		if df, ok := e.Value.(func() error); ok {
-			if err := df(); err != nil {
-				return err
-			}
-			p.todoc--
-			continue
+	if err != nil {
+		// keep what was stored, pushing again continues from there
+		p.lk.Lock()
+		if cerr := p.checkpoint(); cerr != nil {
+			p.log.Printf("checkpoint: %v\n", cerr)
 		}
+		p.lk.Unlock()
+	}
+	return err
+}
+
+// Stats returns the number and total size of objects pushed so far
+func (p *Push) Stats() (objects uint64, bytes uint64) {
+	return p.objects, p.bytes
+}
+
+// Recovered returns the number of objects an interrupted push of the same
+// hash already stored
+func (p *Push) Recovered() uint64 {
+	return p.recovered
+}
+
+// doWork walks commits, trees and tags reachable from base and not yet
+// tracked, emitting them as they are read. Blobs, which make up most of the
+// data, are only collected and then streamed in pack order.
+func (p *Push) doWork(ctx context.Context) error {
+	base := p.base
+	has, err := p.hasEntry(base[:])
+	if err != nil {
+		return fmt.Errorf("push: %v", err)
+	}
+	if has {
+		return nil
+	}
+
+	recovered, ok, err := p.tracker.Journal(base[:])
+	if err != nil {
+		return fmt.Errorf("push: %v", err)
+	}
+	if ok {
+		p.recovered = recovered
+		p.log.Printf("resuming interrupted push, %d objects already stored\n", recovered)
+	}
+
+	todo := list.New()
+	todo.PushBack(base)
+	p.graph[base] = &pushNode{}
+	var blobs []plumbing.Hash
+	p.todoc++
 
-		hash := e.Value.(string)
+	for e := todo.Front(); e != nil; e = e.Next() {
+		hash := e.Value.(plumbing.Hash)
 
-		sha, err := hex.DecodeString(hash)
+		raw, err := p.readObject(hash)
 		if err != nil {
-			return fmt.Errorf("push: %v", err)
+			return err
 		}
 
-		_, processing := p.processing[string(sha)]
-		if processing {
-			p.todoc--
-			continue
+		walk, blobLinks, err := objectLinks(raw)
+		if err != nil {
+			return fmt.Errorf("push/processLinks(%s): %v", hash, err)
 		}
 
-		has, err := p.tracker.HasEntry(sha)
-		if err != nil {
-			return fmt.Errorf("push/process: %v", err)
+		p.lk.Lock()
+		node := p.graph[hash]
+		for i, link := range append(walk, blobLinks...) {
+			if n, ok := p.graph[link]; ok {
+				// reached through another path before
+				if !n.done {
+					n.parents = append(n.parents, hash)
+					node.missing++
+				}
+				continue
+			}
+
+			has, err := p.hasEntry(link[:])
+			if err != nil {
+				p.lk.Unlock()
+				return fmt.Errorf("push/process: %v", err)
+			}
+			if has {
+				p.graph[link] = &pushNode{done: true}
+				continue
+			}
+
+			p.graph[link] = &pushNode{parents: []plumbing.Hash{hash}}
+			node.missing++
+			p.todoc++
+			if i < len(walk) {
+				todo.PushBack(link)
+			} else {
+				blobs = append(blobs, link)
+			}
 		}
+		p.lk.Unlock()
 
-		if has {
-			p.todoc--
-			continue
+		if err := p.emit(ctx, hash, raw); err != nil {
+			return err
 		}
+	}
 
-		expectedCid, err := CidFromHex(hash)
-		if err != nil {
-			return fmt.Errorf("push: %v", err)
+	streamed := map[plumbing.Hash]bool{}
+	err = p.packs.Stream(blobs, func(hash plumbing.Hash, raw []byte) error {
+		streamed[hash] = true
+		return p.emit(ctx, hash, raw)
+	})
+	if err != nil {
+		return fmt.Errorf("push: %v", err)
+	}
+
+	for _, hash := range blobs {
+		if streamed[hash] {
+			continue
 		}
 
-		obj, err := p.repo.Storer.EncodedObject(plumbing.AnyObject, plumbing.NewHash(hash))
+		raw, err := p.readLoose(hash)
 		if err != nil {
-			return fmt.Errorf("push/getObject(%s): %v", hash, err)
+			return err
+		}
+		if err := p.emit(ctx, hash, raw); err != nil {
+			return err
 		}
+	}
 
-		rawReader, err := obj.Reader()
-		if err != nil {
+	if err := p.wait(ctx); err != nil {
+		return err
+	}
+
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	if !p.graph[base].done {
+		return fmt.Errorf("push: %s incomplete", base)
+	}
+	if !p.DryRun {
+		if err := p.tracker.RemoveJournal(base[:]); err != nil {
 			return fmt.Errorf("push: %v", err)
 		}
-
-		raw, err := ioutil.ReadAll(rawReader)
-		if err != nil {
+		if err := p.tracker.Flush(); err != nil {
 			return fmt.Errorf("push: %v", err)
 		}
+	}
 
-		switch obj.Type() {
-		case plumbing.CommitObject:
-			raw = append([]byte(fmt.Sprintf("commit %d\x00", obj.Size())), raw...)
-		case plumbing.TreeObject:
-			raw = append([]byte(fmt.Sprintf("tree %d\x00", obj.Size())), raw...)
-		case plumbing.BlobObject:
-			raw = append([]byte(fmt.Sprintf("blob %d\x00", obj.Size())), raw...)
-		case plumbing.TagObject:
-			raw = append([]byte(fmt.Sprintf("tag %d\x00", obj.Size())), raw...)
-		}
+	p.log.Printf("\n")
+	return nil
+}
 
-		p.done++
-		if p.done%100 == 0 || p.done == p.todoc {
-			p.log.Printf("%d/%d (P:%d) %s %s\r\x1b[A", p.done, p.todoc, len(p.processing), hash, expectedCid.String())
-		}
+// emit stores a single raw object in the background, objects stored by an
+// interrupted push are only marked
+func (p *Push) emit(ctx context.Context, hash plumbing.Hash, raw []byte) error {
+	select {
+	case err := <-p.errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	p.lk.Lock()
+	recovered, err := p.tracker.HasStored(hash[:])
+	if err == nil && recovered {
+		p.graph[hash].marked = true
+		err = p.markStored(hash, false)
+	}
+	p.lk.Unlock()
+	if err != nil {
+		return fmt.Errorf("push: %v", err)
+	}
+
+	expectedCid, err := CidFromHex(hash.String())
+	if err != nil {
+		return fmt.Errorf("push: %v", err)
+	}
+
+	p.done++
+	if p.done%100 == 0 || p.done == p.todoc {
+		p.log.Printf("%d/%d %s %s\r\x1b[A", p.done, p.todoc, hash, expectedCid.String())
+	}
+	if recovered {
+		return nil
+	}
 
-		p.wg.Add()
-		go func() {
-			defer p.wg.Done()
+	p.objects++
+	p.bytes += uint64(len(raw))
+
+	if err := p.wg.AddWithContext(ctx); err != nil {
+		return err
+	}
+	go func() {
+		defer p.wg.Done()
 
-			res, err := api.BlockPut(raw, "git-raw", "sha1", -1)
+		if !p.DryRun {
+			var res string
+			err := p.limiter.Do(ctx, func(ctx context.Context) (err error) {
+				res, err = p.store.Put(ctx, raw)
+				return err
+			})
 			if err != nil {
-				p.errCh <- fmt.Errorf("push/put: %v", err)
+				p.fail(fmt.Errorf("push/put: %v", err))
 				return
 			}
 
 			if expectedCid.String() != res {
-				p.errCh <- fmt.Errorf("CIDs don't match: expected %s, got %s", expectedCid.String(), res)
+				p.fail(fmt.Errorf("CIDs don't match: expected %s, got %s", expectedCid.String(), res))
 				return
 			}
+		}
 
-			if p.NewNode != nil {
-				if err := p.NewNode(expectedCid, raw); err != nil {
-					p.errCh <- fmt.Errorf("newNode: %s", err)
-					return
-				}
+		if p.NewNode != nil {
+			if err := p.NewNode(expectedCid, raw); err != nil {
+				p.fail(fmt.Errorf("newNode: %s", err))
+				return
 			}
-		}()
+		}
 
-		n, err := p.processLinks(raw, sha)
+		p.lk.Lock()
+		err := p.markStored(hash, true)
+		p.lk.Unlock()
 		if err != nil {
-			return fmt.Errorf("push/processLinks: %v", err)
+			p.fail(fmt.Errorf("push: %v", err))
 		}
+	}()
+	return nil
+}
 
-		if n == 0 {
-			p.todoc++
-			p.todo.PushBack(p.doneFunc(sha))
-		} else {
-			p.processing[string(sha)] = n
-		}
+// markStored records a stored object, it's confirmed once nothing is
+// missing below it. Callers hold lk.
+func (p *Push) markStored(hash plumbing.Hash, fresh bool) error {
+	node := p.graph[hash]
+	node.stored = true
 
-		select {
-		case e := <-p.errCh:
-			return e
-		default:
+	if node.missing == 0 {
+		if err := p.confirm(hash); err != nil {
+			return err
 		}
+	} else if fresh && !p.DryRun {
+		if err := p.tracker.AddStored(hash[:]); err != nil {
+			return err
+		}
+		node.marked = true
+	}
+
+	if !fresh || p.DryRun {
+		return nil
+	}
+	p.stored++
+	p.unflushed++
+	if p.unflushed >= pushCheckpoint {
+		return p.checkpoint()
 	}
-	p.log.Printf("\n")
 	return nil
 }
 
-func (p *Push) doneFunc(sha []byte) func() error {
-	return func() error {
-		if err := p.tracker.AddEntry(sha); err != nil {
-			return err
+// confirm adds a complete object to the tracker, along with parents which
+// were only waiting for it
+func (p *Push) confirm(hash plumbing.Hash) error {
+	ready := []plumbing.Hash{hash}
+	for len(ready) > 0 {
+		h := ready[len(ready)-1]
+		ready = ready[:len(ready)-1]
+
+		node := p.graph[h]
+		node.done = true
+
+		if p.DryRun {
+			p.dryDone[string(h[:])] = true
+		} else {
+			if node.marked {
+				if err := p.tracker.RemoveStored(h[:]); err != nil {
+					return err
+				}
+			}
+			if err := p.tracker.AddEntry(h[:]); err != nil {
+				return err
+			}
 		}
-		delete(p.processing, string(sha))
 
-		for _, sub := range p.subs[string(sha)] {
-			p.processing[string(sub)]--
-			if p.processing[string(sub)] <= 0 {
-				p.todoc++
-				p.todo.PushBack(p.doneFunc(sub))
+		for _, parent := range node.parents {
+			pn := p.graph[parent]
+			pn.missing--
+			if pn.missing == 0 && pn.stored {
+				ready = append(ready, parent)
 			}
 		}
-		delete(p.subs, string(sha))
+		node.parents = nil
+	}
+	return nil
+}
+
+// checkpoint makes progress durable, callers hold lk
+func (p *Push) checkpoint() error {
+	if p.DryRun || p.stored == 0 {
+		return nil
+	}
+
+	if err := p.tracker.SetJournal(p.base[:], p.recovered+p.stored); err != nil {
+		return err
+	}
+	p.unflushed = 0
+	return p.tracker.Flush()
+}
+
+// fail records the first error of a background put, later ones are dropped
+// so workers never block
+func (p *Push) fail(err error) {
+	select {
+	case p.errCh <- err:
+	default:
+	}
+}
+
+// wait waits for all pending puts, returning the first error
+func (p *Push) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case err := <-p.errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+	}
+
+	// a put may have failed just before the last one finished
+	select {
+	case err := <-p.errCh:
+		return err
+	default:
 		return nil
 	}
 }
 
-func (p *Push) processLinks(object []byte, selfSha []byte) (int, error) {
-	nd, err := ipldgit.ParseObjectFromBuffer(object)
+// readObject returns the raw object, packed or loose
+func (p *Push) readObject(hash plumbing.Hash) ([]byte, error) {
+	raw, found, err := p.packs.Read(hash)
 	if err != nil {
-		return 0, fmt.Errorf("push/process: %v", err)
+		return nil, fmt.Errorf("push/getObject(%s): %v", hash, err)
 	}
+	if found {
+		return raw, nil
+	}
+	return p.readLoose(hash)
+}
 
-	var n int
-	links := nd.Links()
-	for _, link := range links {
-		mhash := link.Cid.Hash()
-		decoded, err := mh.Decode(mhash)
-		if err != nil {
-			return 0, fmt.Errorf("push/process: %v", err)
-		}
+func (p *Push) readLoose(hash plumbing.Hash) ([]byte, error) {
+	raw, err := readRawObject(p.repo, hash)
+	if err != nil {
+		return nil, fmt.Errorf("push/getObject(%s): %v", hash, err)
+	}
+	return raw, nil
+}
 
-		if _, proc := p.processing[string(decoded.Digest)]; !proc {
-			has, err := p.tracker.HasEntry(decoded.Digest)
-			if err != nil {
-				return 0, fmt.Errorf("push/process: %v", err)
-			}
+// readRawObject reads an object through go-git, with its git header
+func readRawObject(repo *git.Repository, hash plumbing.Hash) ([]byte, error) {
+	obj, err := repo.Storer.EncodedObject(plumbing.AnyObject, hash)
+	if err != nil {
+		return nil, err
+	}
 
-			if has {
-				continue
+	rawReader, err := obj.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer rawReader.Close()
+
+	raw, err := ioutil.ReadAll(rawReader)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(fmt.Sprintf("%s %d\x00", obj.Type(), obj.Size())), raw...), nil
+}
+
+// objectLinks returns objects referenced by a commit, tree or tag, split into
+// ones which need to be read to continue the walk and blobs
+func objectLinks(raw []byte) (walk []plumbing.Hash, blobs []plumbing.Hash, err error) {
+	typ, data, err := splitObject(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	obj := &plumbing.MemoryObject{}
+	obj.SetType(typ)
+	if _, err := obj.Write(data); err != nil {
+		return nil, nil, err
+	}
+
+	switch typ {
+	case plumbing.CommitObject:
+		var c object.Commit
+		if err := c.Decode(obj); err != nil {
+			return nil, nil, err
+		}
+		return append([]plumbing.Hash{c.TreeHash}, c.ParentHashes...), nil, nil
+	case plumbing.TreeObject:
+		var t object.Tree
+		if err := t.Decode(obj); err != nil {
+			return nil, nil, err
+		}
+
+		for _, e := range t.Entries {
+			switch e.Mode {
+			case filemode.Dir:
+				walk = append(walk, e.Hash)
+			case filemode.Submodule:
+				// commits of other repositories
+			default:
+				blobs = append(blobs, e.Hash)
 			}
 		}
+		return walk, blobs, nil
+	case plumbing.TagObject:
+		var t object.Tag
+		if err := t.Decode(obj); err != nil {
+			return nil, nil, err
+		}
 
-		p.subs[string(decoded.Digest)] = append(p.subs[string(decoded.Digest)], selfSha)
+		if t.TargetType == plumbing.BlobObject {
+			return nil, []plumbing.Hash{t.Target}, nil
+		}
+		return []plumbing.Hash{t.Target}, nil, nil
+	}
+	return nil, nil, nil
+}
 
-		n++
-		p.todoc++
-		p.todo.PushBack(hex.EncodeToString(decoded.Digest))
+func (p *Push) hasEntry(sha []byte) (bool, error) {
+	if p.dryDone[string(sha)] {
+		return true, nil
 	}
-	return n, nil
+	return p.tracker.HasEntry(sha)
 }
@@ -0,0 +1,213 @@
+package core
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs-shipyard/git-remote-ipld/util"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// packMock copies the mock repository and moves all its objects into a
+// delta compressed pack
+func packMock(t *testing.T) (string, map[string][]byte) {
+	tmpdir, err := ioutil.TempDir("", "push-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gitDir := filepath.Join(tmpdir, ".git")
+	if err := util.CopyDir(filepath.Join("..", "mock", "git"), gitDir); err != nil {
+		t.Fatal(err)
+	}
+
+	objectDir := filepath.Join(gitDir, "objects")
+	loose, err := filepath.Glob(filepath.Join(objectDir, "??", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := NewPackWriter(objectDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Deltas = true
+
+	objects := map[string][]byte{}
+	for _, p := range loose {
+		compressed, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hash := filepath.Base(filepath.Dir(p)) + filepath.Base(p)
+		objects[hash] = raw
+		if err := w.Add(hash, raw); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	return tmpdir, objects
+}
+
+func TestPushFromPack(t *testing.T) {
+	tmpdir, objects := packMock(t)
+	defer os.RemoveAll(tmpdir)
+
+	gitDir := filepath.Join(tmpdir, ".git")
+	repo, err := git.PlainOpen(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracker, err := NewTracker(gitDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.Close()
+
+	store, err := NewFileStore(filepath.Join(tmpdir, "blocks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// french, its parent and master
+	push := NewPush(gitDir, tracker, repo, store, NewLimiter(4))
+	if err := push.PushHash(context.Background(), "162429cc0dac923dff140ec29247f42a8e362419"); err != nil {
+		t.Fatal(err)
+	}
+
+	pushed, _ := push.Stats()
+	if pushed == 0 {
+		t.Fatal("nothing pushed")
+	}
+
+	for _, hash := range []string{"162429cc0dac923dff140ec29247f42a8e362419", "31f087b9bf39d5bcbba5d4e80b2b4ff19a71dc00", "d5b0d08c180fd7a9bf4f684a37e60ceeb4d25ec8"} {
+		c, err := CidFromHex(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := store.Get(context.Background(), c.String())
+		if err != nil {
+			t.Fatalf("%s: %v", hash, err)
+		}
+		if !bytes.Equal(data, objects[hash]) {
+			t.Fatalf("%s: stored object differs", hash)
+		}
+	}
+
+	// everything is tracked, pushing again is a no-op
+	again := NewPush(gitDir, tracker, repo, store, NewLimiter(4))
+	if err := again.PushHash(context.Background(), "162429cc0dac923dff140ec29247f42a8e362419"); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := again.Stats(); n != 0 {
+		t.Fatalf("pushed %d objects again", n)
+	}
+}
+
+func TestPushResume(t *testing.T) {
+	tmpdir, objects := packMock(t)
+	defer os.RemoveAll(tmpdir)
+
+	gitDir := filepath.Join(tmpdir, ".git")
+	repo, err := git.PlainOpen(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks, err := NewFileStore(filepath.Join(tmpdir, "blocks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracker, err := NewTracker(gitDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const hash = "162429cc0dac923dff140ec29247f42a8e362419"
+	store := &countingStore{BlockStore: blocks, interruptPut: 4, cancel: cancel}
+	if err := NewPush(gitDir, tracker, repo, store, NewLimiter(1)).PushHash(ctx, hash); err == nil {
+		t.Fatal("expected interrupted push to fail")
+	}
+	if err := tracker.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tracker, err = NewTracker(gitDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.Close()
+
+	base := plumbing.NewHash(hash)
+	stored, ok, err := tracker.Journal(base[:])
+	if err != nil || !ok {
+		t.Fatalf("no journal of the interrupted push: %v", err)
+	}
+	if stored != 3 {
+		t.Fatalf("expected 3 objects in journal, got %d", stored)
+	}
+
+	store = &countingStore{BlockStore: blocks}
+	push := NewPush(gitDir, tracker, repo, store, NewLimiter(4))
+	if err := push.PushHash(context.Background(), hash); err != nil {
+		t.Fatal(err)
+	}
+
+	if push.Recovered() != stored {
+		t.Fatalf("expected %d recovered objects, got %d", stored, push.Recovered())
+	}
+	linked := reachable(t, objects, hash)
+	if int(store.puts) != len(linked)-int(stored) {
+		t.Fatalf("resumed push stored %d objects, expected %d", store.puts, len(linked)-int(stored))
+	}
+
+	for h := range linked {
+		if has, err := tracker.HasEntry(h[:]); err != nil || !has {
+			t.Fatalf("%s not tracked: %v", h, err)
+		}
+		if marked, err := tracker.HasStored(h[:]); err != nil || marked {
+			t.Fatalf("%s still marked: %v", h, err)
+		}
+		if has, err := blocks.Has(context.Background(), mustCid(t, h.String())); err != nil || !has {
+			t.Fatalf("%s not stored: %v", h, err)
+		}
+	}
+	if _, ok, _ := tracker.Journal(base[:]); ok {
+		t.Fatal("journal kept after push finished")
+	}
+}
+
+func mustCid(t *testing.T, hash string) string {
+	c, err := CidFromHex(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.String()
+}
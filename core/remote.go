@@ -2,25 +2,64 @@ package core
 
 import (
 	"bufio"
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+)
+
+// ErrNonFastForward is returned by RemoteHandler.Push when a non-forced push
+// would drop commits from the remote ref
+var ErrNonFastForward = errors.New("non-fast-forward")
+
+// ErrNoRemoteRef is returned by RemoteHandler.Push when asked to delete a ref
+// which doesn't exist
+var ErrNoRemoteRef = errors.New("remote ref does not exist")
+
+// ErrFetchFirst is returned by RemoteHandler.Publish for refs someone else
+// updated since the push started, git tells the user to fetch first
+var ErrFetchFirst = errors.New("fetch first")
+
+const (
+	// FETCH_JOBS_ENV and PUSH_JOBS_ENV override the ipld.fetchJobs and
+	// ipld.pushJobs git config options
+	FETCH_JOBS_ENV = "GIT_IPLD_FETCH_JOBS"
+	PUSH_JOBS_ENV  = "GIT_IPLD_PUSH_JOBS"
+
+	// BLOCK_TIMEOUT_ENV and TIMEOUT_ENV override ipld.blockTimeout, the
+	// limit for a single block request, and ipld.timeout, the limit for the
+	// whole command batch
+	BLOCK_TIMEOUT_ENV = "GIT_IPLD_BLOCK_TIMEOUT"
+	TIMEOUT_ENV       = "GIT_IPLD_TIMEOUT"
 )
 
 type RemoteHandler interface {
-	List(remote *Remote, forPush bool) ([]string, error)
-	Push(remote *Remote, localRef string, remoteRef string) (string, error)
+	List(ctx context.Context, remote *Remote, forPush bool) ([]string, error)
+	Push(ctx context.Context, remote *Remote, localRef string, remoteRef string, force bool) (string, error)
+
+	// Publish makes refs pushed in this batch visible on the remote, git is
+	// told about the push only after it returns. Refs which couldn't be
+	// published are returned with the reason, an error fails all of them.
+	Publish(ctx context.Context, remote *Remote, refs []string) (map[string]error, error)
 
-	Initialize(remote *Remote) error
-	Finish(remote *Remote) error
+	Initialize(ctx context.Context, remote *Remote) error
+	Finish(ctx context.Context, remote *Remote) error
 
-	ProvideBlock(cid string, tracker *Tracker) ([]byte, error)
+	ProvideBlock(ctx context.Context, cid string, tracker *Tracker) ([]byte, error)
 }
 
 type Remote struct {
@@ -31,26 +70,59 @@ type Remote struct {
 
 	Repo    *git.Repository
 	Tracker *Tracker
+	Store   BlockStore
 
 	Handler RemoteHandler
+	Options Options
+
+	// PackDeltas enables delta compression of packs written by fetch
+	PackDeltas bool
+
+	fetchLimiter *Limiter
+	pushLimiter  *Limiter
 
-	todo []func() (string, error)
+	// timeout of the whole command batch, 0 means no timeout
+	timeout time.Duration
+
+	todo   []func(ctx context.Context) (string, error)
+	pushed []pushStatus
+}
+
+// pushStatus is how pushing a single ref went, reported once the batch is
+// published
+type pushStatus struct {
+	ref string
+	err error
 }
 
-func NewRemote(handler RemoteHandler, reader io.Reader, writer io.Writer, logger *log.Logger) (*Remote, error) {
+// NewRemote sets up a remote for the repository in GIT_DIR, ctx bounds the
+// initialization of the handler
+func NewRemote(ctx context.Context, handler RemoteHandler, store BlockStore, reader io.Reader, writer io.Writer, logger *log.Logger) (*Remote, error) {
 	localDir, err := GetLocalDir()
 	if err != nil {
 		return nil, err
 	}
 
-	repo, err := git.PlainOpen(localDir)
-	if err == git.ErrWorktreeNotProvided {
-		repoRoot, _ := path.Split(localDir)
+	repo, err := OpenRepo(localDir)
+	if err != nil {
+		return nil, err
+	}
 
-		repo, err = git.PlainOpen(repoRoot)
-		if err != nil {
-			return nil, err
-		}
+	fetchJobs, err := ConfigJobs(localDir, "fetchJobs", FETCH_JOBS_ENV)
+	if err != nil {
+		return nil, err
+	}
+	pushJobs, err := ConfigJobs(localDir, "pushJobs", PUSH_JOBS_ENV)
+	if err != nil {
+		return nil, err
+	}
+	blockTimeout, err := configDuration(localDir, "blockTimeout", BLOCK_TIMEOUT_ENV, DefaultBlockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := configDuration(localDir, "timeout", TIMEOUT_ENV, 0)
+	if err != nil {
+		return nil, err
 	}
 
 	tracker, err := NewTracker(localDir)
@@ -70,49 +142,322 @@ func NewRemote(handler RemoteHandler, reader io.Reader, writer io.Writer, logger
 
 		Repo:    repo,
 		Tracker: tracker,
+		Store:   store,
 
 		Handler: handler,
+		Options: defaultOptions(),
+
+		fetchLimiter: NewLimiter(fetchJobs),
+		pushLimiter:  NewLimiter(pushJobs),
+
+		timeout: timeout,
 	}
+	remote.fetchLimiter.Timeout = blockTimeout
+	remote.pushLimiter.Timeout = blockTimeout
 
-	if err := handler.Initialize(remote); err != nil {
+	if err := handler.Initialize(ctx, remote); err != nil {
+		tracker.Close()
 		return nil, err
 	}
 
 	return remote, nil
 }
 
+// OpenRepo opens the repository owning gitDir
+func OpenRepo(gitDir string) (*git.Repository, error) {
+	repo, err := git.PlainOpen(gitDir)
+	if err == git.ErrWorktreeNotProvided {
+		repoRoot, _ := path.Split(gitDir)
+
+		repo, err = git.PlainOpen(repoRoot)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
 func (r *Remote) Printf(format string, a ...interface{}) (n int, err error) {
-	r.Logger.Printf("> "+format, a...)
+	r.tracef("> "+format, a...)
 	return fmt.Fprintf(r.writer, format, a...)
 }
 
+// tracef logs protocol traffic, shown with `git -v`
+func (r *Remote) tracef(format string, a ...interface{}) {
+	if r.Options.Verbosity >= 2 {
+		r.Logger.Printf(format, a...)
+	}
+}
+
 func (r *Remote) NewPush() *Push {
-	return NewPush(r.localDir, r.Tracker, r.Repo)
+	push := NewPush(r.localDir, r.Tracker, r.Repo, r.Store, r.pushLimiter)
+	if !r.showProgress() {
+		push.log.SetOutput(ioutil.Discard)
+	}
+	return push
 }
 
 func (r *Remote) NewFetch() *Fetch {
-	return NewFetch(r.localDir, r.Tracker, r.Handler.ProvideBlock)
+	fetch := NewFetch(r.localDir, r.Tracker, r.Store, r.Handler.ProvideBlock, r.fetchLimiter)
+	fetch.Depth = r.Options.Depth
+	fetch.Since = r.Options.DeepenSince
+	fetch.Deltas = r.PackDeltas
+	if !r.showProgress() {
+		fetch.log.SetOutput(ioutil.Discard)
+	}
+	return fetch
+}
+
+// configValue reads a setting from the environment or from the ipld section
+// of git config, name tells which one was used
+func configValue(gitDir, key, env string) (value string, name string, err error) {
+	if value := os.Getenv(env); value != "" {
+		return value, env, nil
+	}
+
+	name = "ipld." + key
+	value, err = gitConfig(gitDir, name)
+	return value, name, err
+}
+
+// gitConfig runs `git config --get`, so global and system settings apply
+// as well as those of the repository. Unset names give an empty value.
+func gitConfig(gitDir, name string) (string, error) {
+	out, err := exec.Command("git", "--git-dir", gitDir, "config", "--get", name).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			return "", nil
+		}
+		return "", fmt.Errorf("git config %s: %v", name, err)
+	}
+	return strings.TrimSpace(string(out)), nil
 }
 
+// ConfigJobs reads the number of parallel requests
+func ConfigJobs(gitDir, key, env string) (int, error) {
+	value, name, err := configValue(gitDir, key, env)
+	if err != nil {
+		return 0, err
+	}
+
+	if value == "" {
+		return DefaultJobs, nil
+	}
+
+	jobs, err := strconv.Atoi(value)
+	if err != nil || jobs < 1 {
+		return 0, fmt.Errorf("invalid %s value %q", name, value)
+	}
+	return jobs, nil
+}
+
+// RemoteConfigValue reads a setting of a single remote from the environment
+// or from the ipld.<remote> subsection of git config
+func (r *Remote) RemoteConfigValue(remote, key, env string) (value string, name string, err error) {
+	if value := os.Getenv(env); value != "" {
+		return value, env, nil
+	}
+
+	name = "ipld." + remote + "." + key
+	value, err = gitConfig(r.localDir, name)
+	return value, name, err
+}
+
+// ConfigBool reads a boolean setting, see configValue
+func (r *Remote) ConfigBool(key, env string, def bool) (bool, error) {
+	value, name, err := configValue(r.localDir, key, env)
+	if err != nil {
+		return false, err
+	}
+
+	if value == "" {
+		return def, nil
+	}
+
+	b, err := parseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s value %q", name, value)
+	}
+	return b, nil
+}
+
+// ConfigInt reads a non-negative number, see configValue
+func (r *Remote) ConfigInt(key, env string, def int) (int, error) {
+	value, name, err := configValue(r.localDir, key, env)
+	if err != nil {
+		return 0, err
+	}
+
+	if value == "" {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s value %q", name, value)
+	}
+	return n, nil
+}
+
+// parseBool also accepts the yes/no and on/off spellings of git config
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes", "on":
+		return true, nil
+	case "no", "off":
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// configDuration reads a timeout such as "30s", 0 disables it
+func configDuration(gitDir, key, env string, def time.Duration) (time.Duration, error) {
+	value, name, err := configValue(gitDir, key, env)
+	if err != nil {
+		return 0, err
+	}
+
+	if value == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s value %q", name, value)
+	}
+	return d, nil
+}
+
+// BlockTimeout bounds single requests to IPFS, 0 means no limit
+func (r *Remote) BlockTimeout() time.Duration {
+	return r.fetchLimiter.Timeout
+}
+
+func (r *Remote) showProgress() bool {
+	return r.Options.Progress && r.Options.Verbosity > 0
+}
+
+// IsFastForward checks whether newHash is a descendant of oldHash. Commits
+// missing from the local repository are never a fast-forward.
+func (r *Remote) IsFastForward(oldHash, newHash plumbing.Hash) (bool, error) {
+	if oldHash == newHash {
+		return true, nil
+	}
+
+	if _, err := r.Repo.CommitObject(oldHash); err != nil {
+		if err == plumbing.ErrObjectNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+
+	newCommit, err := r.Repo.CommitObject(newHash)
+	if err != nil {
+		if err == plumbing.ErrObjectNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+
+	found := false
+	err = object.NewCommitPreorderIter(newCommit, nil, nil).ForEach(func(c *object.Commit) error {
+		if c.Hash == oldHash {
+			found = true
+			return storer.ErrStop
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return found, nil
+}
+
+// Close releases the handler, the store and the tracker, also when the
+// commands failed half way
 func (r *Remote) Close() error {
+	if closer, ok := r.Handler.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+	if closer, ok := r.Store.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
 	return r.Tracker.Close()
 }
 
 func (r *Remote) push(src, dst string, force bool) {
-	r.todo = append(r.todo, func() (string, error) {
-		done, err := r.Handler.Push(r, src, dst)
+	r.todo = append(r.todo, func(ctx context.Context) (string, error) {
+		done, err := r.Handler.Push(ctx, r, src, dst, force)
 		if err != nil {
-			return "", err
+			if ctx.Err() != nil {
+				// interrupted or timed out, remaining refs would fail too
+				return "", err
+			}
+
+			// report the failure for this ref only and let other refs proceed
+			r.pushed = append(r.pushed, pushStatus{ref: dst, err: err})
+			return "", nil
 		}
 
-		return fmt.Sprintf("ok %s\n", done), nil
+		r.pushed = append(r.pushed, pushStatus{ref: done})
+		return "", nil
 	})
 }
 
+// reportPush publishes the refs pushed in this batch and tells git how each
+// of them went, a ref is only ok once it is published
+func (r *Remote) reportPush(ctx context.Context) error {
+	var refs []string
+	for _, s := range r.pushed {
+		if s.err == nil {
+			refs = append(refs, s.ref)
+		}
+	}
+
+	var failed map[string]error
+	if len(refs) > 0 {
+		var err error
+		failed, err = r.Handler.Publish(ctx, r, refs)
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			failed = map[string]error{}
+			for _, ref := range refs {
+				failed[ref] = err
+			}
+		}
+	}
+
+	for _, s := range r.pushed {
+		err := s.err
+		if err == nil {
+			err = failed[s.ref]
+		}
+		if err != nil {
+			r.Logger.Printf("push %s: %v\n", s.ref, err)
+			reason := strings.Replace(err.Error(), "\n", " ", -1)
+			r.Printf("error %s %s\n", s.ref, reason)
+			continue
+		}
+		r.Printf("ok %s\n", s.ref)
+	}
+	r.pushed = nil
+	return nil
+}
+
 func (r *Remote) fetch(sha, ref string) {
-	r.todo = append(r.todo, func() (string, error) {
+	r.todo = append(r.todo, func(ctx context.Context) (string, error) {
 		fetch := r.NewFetch()
-		err := fetch.FetchHash(sha)
+		err := fetch.FetchHash(ctx, sha)
 		if err != nil {
 			return "", fmt.Errorf("command fetch: %v", err)
 		}
@@ -127,7 +472,15 @@ func (r *Remote) fetch(sha, ref string) {
 	})
 }
 
-func (r *Remote) ProcessCommands() error {
+// ProcessCommands handles commands sent by git until the first batch is done,
+// cancelling ctx stops any work in progress
+func (r *Remote) ProcessCommands(ctx context.Context) error {
+	if r.timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+
 	reader := bufio.NewReader(r.reader)
 loop:
 	for {
@@ -138,14 +491,22 @@ loop:
 
 		command = strings.Trim(command, "\n")
 
-		r.Logger.Printf("< %s", command)
+		r.tracef("< %s", command)
 		switch {
 		case command == "capabilities":
 			r.Printf("push\n")
 			r.Printf("fetch\n")
+			r.Printf("option\n")
 			r.Printf("\n")
+		case strings.HasPrefix(command, "option "):
+			parts := strings.SplitN(command, " ", 3)
+			if len(parts) != 3 {
+				r.Printf("error invalid option\n")
+				continue
+			}
+			r.Printf("%s\n", r.Options.set(parts[1], parts[2]))
 		case strings.HasPrefix(command, "list"):
-			list, err := r.Handler.List(r, strings.HasPrefix(command, "list for-push"))
+			list, err := r.Handler.List(ctx, r, strings.HasPrefix(command, "list for-push"))
 			if err != nil {
 				return err
 			}
@@ -155,21 +516,25 @@ loop:
 			r.Printf("\n")
 		case strings.HasPrefix(command, "push "):
 			refs := strings.Split(command[5:], ":")
-			r.push(refs[0], refs[1], false) //TODO: parse force
+			force := strings.HasPrefix(refs[0], "+")
+			r.push(strings.TrimPrefix(refs[0], "+"), refs[1], force)
 		case strings.HasPrefix(command, "fetch "):
 			parts := strings.Split(command, " ")
 			r.fetch(parts[1], parts[2])
 		case command == "":
 			fallthrough
 		case command == "\n":
-			r.Logger.Println("Processing tasks")
+			r.tracef("Processing tasks")
 			for _, task := range r.todo {
-				resp, err := task()
+				resp, err := task(ctx)
 				if err != nil {
 					return err
 				}
 				r.Printf("%s", resp)
 			}
+			if err := r.reportPush(ctx); err != nil {
+				return err
+			}
 			r.Printf("\n")
 			r.todo = nil
 			break loop
@@ -178,5 +543,5 @@ loop:
 		}
 	}
 
-	return r.Handler.Finish(r)
+	return r.Handler.Finish(ctx, r)
 }
@@ -0,0 +1,65 @@
+package core
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ipfs "github.com/ipfs/go-ipfs-api"
+)
+
+// Shell builds go-ipfs-api requests that are bound to a context. The
+// library accepts a context in Exec and Send but never attaches it to the
+// http request, so a hung daemon would block forever without this.
+type Shell struct {
+	url       string
+	transport http.RoundTripper
+}
+
+func NewShell(url string) *Shell {
+	return &Shell{
+		url: url,
+		transport: &http.Transport{
+			Proxy:             http.ProxyFromEnvironment,
+			DisableKeepAlives: true,
+		},
+	}
+}
+
+// NewLocalShell connects to the daemon of the repo in IPFS_PATH, nil is
+// returned if no daemon is running there
+func NewLocalShell() *Shell {
+	dir := os.Getenv(ipfs.EnvDir)
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		dir = filepath.Join(home, ".ipfs")
+	}
+
+	api, err := ioutil.ReadFile(filepath.Join(dir, ipfs.DefaultApiFile))
+	if err != nil {
+		return nil
+	}
+	return NewShell(strings.TrimSpace(string(api)))
+}
+
+// Request starts a request which is cancelled together with ctx, this
+// includes reading the response body
+func (s *Shell) Request(ctx context.Context, command string, args ...string) *ipfs.RequestBuilder {
+	client := &http.Client{Transport: &ctxTransport{ctx: ctx, base: s.transport}}
+	return ipfs.NewShellWithClient(s.url, client).Request(command, args...)
+}
+
+type ctxTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t *ctxTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(req.WithContext(t.ctx))
+}
@@ -0,0 +1,68 @@
+package core
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// hungDaemon accepts requests but never finishes answering them, with
+// headers set only the body hangs
+func hungDaemon(t *testing.T, headers bool) *Shell {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if headers {
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(func() {
+		close(done)
+		srv.Close()
+	})
+	return NewShell(srv.URL)
+}
+
+func TestShellStoreTimeout(t *testing.T) {
+	store := NewShellStore(hungDaemon(t, false))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := store.Get(ctx, "z8mWaJHXieAVxxLagBpdaNWFEBKVWmMiE"); err == nil {
+		t.Fatal("expected get from a hung daemon to fail")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("get wasn't cancelled, took %s", time.Since(start))
+	}
+}
+
+func TestShellCancelBody(t *testing.T) {
+	sh := hungDaemon(t, true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resp, err := sh.Request(ctx, "cat", "/ipfs/QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn").Send(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Close()
+
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	if _, err := ioutil.ReadAll(resp.Output); err == nil {
+		t.Fatal("expected read from a hung daemon to fail")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("read wasn't cancelled, took %s", time.Since(start))
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"strconv"
 
 	"github.com/dgraph-io/badger"
 )
@@ -61,6 +62,18 @@ func (t *Tracker) Set(refName string, hash []byte) error {
 	return txn.Commit()
 }
 
+func (t *Tracker) Delete(refName string) error {
+	txn := t.db.NewTransaction(true)
+	defer txn.Discard()
+
+	err := txn.Delete([]byte(refName))
+	if err != nil {
+		return err
+	}
+
+	return txn.Commit()
+}
+
 func (t *Tracker) ListPrefixed(prefix string) (map[string]string, error) {
 	out := map[string]string{}
 
@@ -82,18 +95,153 @@ func (t *Tracker) ListPrefixed(prefix string) (map[string]string, error) {
 	return out, nil
 }
 
+// pendingPrefix marks objects written by a fetch which didn't finish yet.
+// Entries without it mean the object and everything it links to is local.
+const pendingPrefix = "pending/"
+
+// storedPrefix marks objects stored by a push which didn't finish yet, some
+// of the objects they link to may still be missing
+const storedPrefix = "stored/"
+
+// journalPrefix keeps progress of unfinished pushes by their base hash
+const journalPrefix = "journal/"
+
 func (t *Tracker) AddEntry(hash []byte) error {
+	return t.set(hash, []byte{})
+}
+
+func (t *Tracker) RemoveEntry(hash []byte) error {
+	return t.del(hash)
+}
+
+// AddPending marks an object as being fetched, it isn't treated as present
+// until confirmed
+func (t *Tracker) AddPending(hash []byte) error {
+	return t.set(prefixed(pendingPrefix, hash), []byte{})
+}
+
+func (t *Tracker) RemovePending(hash []byte) error {
+	return t.del(prefixed(pendingPrefix, hash))
+}
+
+func (t *Tracker) HasPending(hash []byte) (bool, error) {
+	return t.HasEntry(prefixed(pendingPrefix, hash))
+}
+
+// ConfirmPending turns a pending mark into a regular entry
+func (t *Tracker) ConfirmPending(hash []byte) error {
+	if err := t.RemovePending(hash); err != nil {
+		return err
+	}
+	return t.AddEntry(hash)
+}
+
+// AddStored marks an object as stored by a push, it isn't treated as present
+// until everything it links to is stored too
+func (t *Tracker) AddStored(hash []byte) error {
+	return t.set(prefixed(storedPrefix, hash), []byte{})
+}
+
+func (t *Tracker) RemoveStored(hash []byte) error {
+	return t.del(prefixed(storedPrefix, hash))
+}
+
+func (t *Tracker) HasStored(hash []byte) (bool, error) {
+	return t.HasEntry(prefixed(storedPrefix, hash))
+}
+
+// SetJournal records the number of objects stored by an unfinished push
+func (t *Tracker) SetJournal(base []byte, stored uint64) error {
+	return t.set(prefixed(journalPrefix, base), []byte(strconv.FormatUint(stored, 10)))
+}
+
+// Journal returns the number of objects stored by an unfinished push of
+// base, ok is false if there is none
+func (t *Tracker) Journal(base []byte) (stored uint64, ok bool, err error) {
 	if t.txn == nil {
 		t.txn = t.db.NewTransaction(true)
 	}
 
-	err := t.txn.Set([]byte(hash), []byte{})
+	item, err := t.txn.Get(prefixed(journalPrefix, base))
+	if err == badger.ErrKeyNotFound {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	v, err := item.ValueCopy(nil)
+	if err != nil {
+		return 0, false, err
+	}
+	stored, err = strconv.ParseUint(string(v), 10, 64)
+	return stored, err == nil, err
+}
+
+func (t *Tracker) RemoveJournal(base []byte) error {
+	return t.del(prefixed(journalPrefix, base))
+}
+
+// ListEntries returns hashes of all tracked objects. Object entries are the
+// only 20 byte keys with no value, refs map to hashes and marks are prefixed.
+func (t *Tracker) ListEntries() ([][]byte, error) {
+	var out [][]byte
+
+	txn := t.db.NewTransaction(false)
+	defer txn.Discard()
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		if len(item.Key()) != 20 || item.ValueSize() != 0 {
+			continue
+		}
+		out = append(out, item.KeyCopy(nil))
+	}
+
+	return out, nil
+}
+
+// Flush commits entries added so far, so they survive a crash
+func (t *Tracker) Flush() error {
+	if t.txn == nil {
+		return nil
+	}
+
+	err := t.txn.Commit()
+	t.txn = nil
+	return err
+}
+
+func (t *Tracker) del(key []byte) error {
+	return t.update(func(txn *badger.Txn) error {
+		return txn.Delete(key)
+	})
+}
+
+func (t *Tracker) set(key, value []byte) error {
+	return t.update(func(txn *badger.Txn) error {
+		return txn.Set(key, value)
+	})
+}
+
+// update applies fn to the shared transaction, committing it and starting
+// a new one when it grows too big
+func (t *Tracker) update(fn func(txn *badger.Txn) error) error {
+	if t.txn == nil {
+		t.txn = t.db.NewTransaction(true)
+	}
+
+	err := fn(t.txn)
 	if err != nil && err.Error() == badger.ErrTxnTooBig.Error() {
 		if err := t.txn.Commit(); err != nil {
 			return fmt.Errorf("commit: %s", err)
 		}
 		t.txn = t.db.NewTransaction(true)
-		if err := t.txn.Set([]byte(hash), []byte{}); err != nil {
+		if err := fn(t.txn); err != nil {
 			return err
 		}
 	} else if err != nil {
@@ -103,6 +251,10 @@ func (t *Tracker) AddEntry(hash []byte) error {
 	return nil
 }
 
+func prefixed(prefix string, hash []byte) []byte {
+	return append([]byte(prefix), hash...)
+}
+
 func (t *Tracker) HasEntry(hash []byte) (bool, error) {
 	if t.txn == nil {
 		t.txn = t.db.NewTransaction(true)
@@ -0,0 +1,154 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+const (
+	unixfsChunkSize = 256 * 1024
+	unixfsMaxLinks  = 174
+)
+
+// BlockPutter stores a block under its cid
+type BlockPutter func(c cid.Cid, data []byte) error
+
+// BlockGetter loads a block by cid
+type BlockGetter func(c cid.Cid) ([]byte, error)
+
+type unixfsEntry struct {
+	link     PBLink
+	fileSize uint64
+}
+
+// BuildUnixfsFile chunks data into a balanced unixfs dag using the default
+// chunk size and fanout of `ipfs add` and returns the root
+func BuildUnixfsFile(data []byte, put BlockPutter) (cid.Cid, uint64, error) {
+	var level []unixfsEntry
+	for off := 0; off < len(data) || off == 0; off += unixfsChunkSize {
+		end := off + unixfsChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		// leaves are files too, not raw nodes, like go-ipfs does it
+		chunk := data[off:end]
+		nd := &PBNode{Data: (&UnixfsData{Type: UnixfsFile, Data: chunk, FileSize: uint64(len(chunk))}).Marshal()}
+		e, err := putUnixfsNode(nd, uint64(len(chunk)), put)
+		if err != nil {
+			return cid.Undef, 0, err
+		}
+		level = append(level, e)
+
+		if end == len(data) {
+			break
+		}
+	}
+
+	for len(level) > 1 {
+		var next []unixfsEntry
+		for i := 0; i < len(level); i += unixfsMaxLinks {
+			end := i + unixfsMaxLinks
+			if end > len(level) {
+				end = len(level)
+			}
+
+			fsData := &UnixfsData{Type: UnixfsFile}
+			nd := &PBNode{}
+			for _, child := range level[i:end] {
+				nd.Links = append(nd.Links, child.link)
+				fsData.FileSize += child.fileSize
+				fsData.BlockSizes = append(fsData.BlockSizes, child.fileSize)
+			}
+			nd.Data = fsData.Marshal()
+
+			e, err := putUnixfsNode(nd, fsData.FileSize, put)
+			if err != nil {
+				return cid.Undef, 0, err
+			}
+			next = append(next, e)
+		}
+		level = next
+	}
+
+	return level[0].link.Hash, level[0].link.Tsize, nil
+}
+
+func putUnixfsNode(nd *PBNode, fileSize uint64, put BlockPutter) (unixfsEntry, error) {
+	c, err := nd.Cid()
+	if err != nil {
+		return unixfsEntry{}, err
+	}
+
+	if err := put(c, nd.Marshal()); err != nil {
+		return unixfsEntry{}, err
+	}
+
+	return unixfsEntry{
+		link:     PBLink{Hash: c, Tsize: nd.Size()},
+		fileSize: fileSize,
+	}, nil
+}
+
+// ReadUnixfsFile reassembles contents of a unixfs file
+func ReadUnixfsFile(c cid.Cid, get BlockGetter) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := readUnixfsFile(&buf, c, get); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func readUnixfsFile(buf *bytes.Buffer, c cid.Cid, get BlockGetter) error {
+	if c.Type() == cid.Raw {
+		data, err := get(c)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		return nil
+	}
+
+	nd, fsData, err := LoadUnixfsNode(c, get)
+	if err != nil {
+		return err
+	}
+
+	if fsData.Type != UnixfsFile && fsData.Type != UnixfsRaw {
+		return fmt.Errorf("%s is not a file", c)
+	}
+
+	buf.Write(fsData.Data)
+	for _, l := range nd.Links {
+		if err := readUnixfsFile(buf, l.Hash, get); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadUnixfsNode loads a dag-pb node along with its unixfs payload
+func LoadUnixfsNode(c cid.Cid, get BlockGetter) (*PBNode, *UnixfsData, error) {
+	if c.Type() != cid.DagProtobuf {
+		return nil, nil, fmt.Errorf("%s is not a dag-pb node", c)
+	}
+
+	data, err := get(c)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nd, err := UnmarshalPBNode(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fsData, err := UnmarshalUnixfs(nd.Data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return nd, fsData, nil
+}
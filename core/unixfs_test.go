@@ -0,0 +1,58 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// golden cids were produced by go-ipfs, `ipfs add` with default settings
+// and `ipfs object new unixfs-dir`
+
+func TestEmptyDirCid(t *testing.T) {
+	c, err := NewDirNode().Cid()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.String() != "QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn" {
+		t.Fatalf("unexpected empty directory cid %s", c)
+	}
+}
+
+func TestUnixfsFileCid(t *testing.T) {
+	big := make([]byte, 300*1024)
+	for i := range big {
+		big[i] = byte(i)
+	}
+
+	for expected, data := range map[string][]byte{
+		"QmbFMke1KXqnYyBBWxB74N4c5SBnJMVAiMNRcGu6x1AwQH": nil,
+		"QmT78zSuBmuS4z925WZfrqQ1qHaJ56DQaTfyMUF7F8ff5o": []byte("hello world\n"),
+		// two chunks under a root node
+		"QmTTa89T7ra72oFqidWXGHTHopuErB56LFReHKYXU745hc": big,
+	} {
+		blocks := map[cid.Cid][]byte{}
+		c, _, err := BuildUnixfsFile(data, func(c cid.Cid, data []byte) error {
+			blocks[c] = data
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.String() != expected {
+			t.Errorf("%d bytes: expected %s, got %s", len(data), expected, c)
+			continue
+		}
+
+		out, err := ReadUnixfsFile(c, func(c cid.Cid) ([]byte, error) {
+			return blocks[c], nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("%s: read back different data", c)
+		}
+	}
+}
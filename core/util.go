@@ -1,8 +1,6 @@
 package core
 
 import (
-	"bytes"
-	"compress/zlib"
 	"fmt"
 	"os"
 	"path"
@@ -11,14 +9,6 @@ import (
 	mh "github.com/multiformats/go-multihash"
 )
 
-func compressObject(in []byte) []byte {
-	var b bytes.Buffer
-	w := zlib.NewWriter(&b)
-	w.Write(in)
-	w.Close()
-	return b.Bytes()
-}
-
 func GetLocalDir() (string, error) {
 	localdir := path.Join(os.Getenv("GIT_DIR"))
 
@@ -6,6 +6,8 @@ require (
 	github.com/dgraph-io/badger v1.6.2
 	github.com/ipfs/go-cid v0.0.2
 	github.com/ipfs/go-ipfs-api v0.0.1
+	github.com/ipfs/go-ipfs-files v0.0.1
+	github.com/ipfs/go-ipld-format v0.0.1
 	github.com/ipfs/go-ipld-git v0.0.2
 	github.com/multiformats/go-multihash v0.0.5
 	github.com/remeh/sizedwaitgroup v0.0.0-20180822144253-5e7302b12cce
@@ -22,9 +24,7 @@ require (
 	github.com/gogo/protobuf v1.3.2 // indirect
 	github.com/golang/protobuf v1.3.1 // indirect
 	github.com/ipfs/go-block-format v0.0.2 // indirect
-	github.com/ipfs/go-ipfs-files v0.0.1 // indirect
 	github.com/ipfs/go-ipfs-util v0.0.1 // indirect
-	github.com/ipfs/go-ipld-format v0.0.1 // indirect
 	github.com/jbenet/go-context v0.0.0-20150711004518-d14ea06fba99 // indirect
 	github.com/kevinburke/ssh_config v0.0.0-20180830205328-81db2a75821e // indirect
 	github.com/libp2p/go-flow-metrics v0.0.1 // indirect